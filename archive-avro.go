@@ -0,0 +1,484 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Encoding of events as Avro object container files, with the schema embedded in the file.
+// Each event is a record having a field for each of the standard fields of the event
+// envelope, and a body field holding a record whose schema belongs to the event's notefile.
+// The schema of each notefile's body is inferred from the events and kept in the archive's
+// data directory, and evolves only by adding nullable fields, so that each file's schema
+// can read every earlier file of the same notefile.
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"sort"
+
+	"github.com/blues/note-go/note"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// File format of Avro archives
+const fileFormatAvro = "avro"
+
+// Compression types that may be specified in file_compression only for Avro archives
+const fileCompressionDeflate = "deflate"
+const fileCompressionSnappy = "snappy"
+
+// Magic number at the start of an Avro object container file
+const avroMagic = "Obj\x01"
+
+// Size of serialized records at which a block is written
+const avroBlockBytes = 1024 * 1024
+
+// Namespace of the records of the schema
+const avroNamespace = "notehub.archive"
+
+// Directory, within an archive's data directory, holding the body schema of each notefile
+const instanceAvroSchemas = "/avro/"
+
+// Kind of a field of a body that holds a nested record
+const avroKindRecord = "record"
+
+// The schema of a notefile's body, or of a record nested within it
+type avroRecord struct {
+	Fields []*avroField `json:"fields"`
+}
+
+// A field of a record, where Key is the field's name in the body and Name is that name as
+// made valid for Avro.  A field that has been widened is a union of null, its kind, and
+// string, holding as a string each value that can't be represented as its kind.
+type avroField struct {
+	Name    string      `json:"name"`
+	Key     string      `json:"key"`
+	Kind    string      `json:"kind"`
+	Record  *avroRecord `json:"record,omitempty"`
+	Widened bool        `json:"widened,omitempty"`
+}
+
+// Make a name valid for Avro, by replacing any character that isn't a letter, digit, or
+// underscore with an underscore, and making sure that it doesn't begin with a digit
+func avroName(name string) string {
+	valid := []byte{}
+	for _, ch := range []byte(name) {
+		if (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') || ch == '_' {
+			valid = append(valid, ch)
+		} else {
+			valid = append(valid, '_')
+		}
+	}
+	if len(valid) == 0 || (valid[0] >= '0' && valid[0] <= '9') {
+		valid = append([]byte{'_'}, valid...)
+	}
+	return string(valid)
+}
+
+// Avro codec implementing the route's file_compression
+func avroCodec(fileCompression string) string {
+	switch fileCompression {
+	case fileCompressionDeflate:
+		return "deflate"
+	case fileCompressionSnappy:
+		return "snappy"
+	case fileCompressionZstd:
+		return "zstandard"
+	}
+	return "null"
+}
+
+// Path of the file holding the body schema of a notefile
+func avroSchemaPath(archiveID string, notefileID string) string {
+	return configDataPath(archiveID+instanceAvroSchemas) + url.PathEscape(notefileID) + ".json"
+}
+
+// Encoder for Avro object container files
+type avroEncoder struct {
+	w         io.Writer
+	archiveID string
+	codec     string
+	sync      []byte
+	notefiles map[string]*avroRecord
+	branches  map[string]int
+	block     bytes.Buffer
+	count     int64
+	started   bool
+	err       error
+}
+
+// Create an Avro encoder for the route's file_compression
+func newAvroEncoder(rc RouteConfig, w io.Writer) (encoder *avroEncoder, err error) {
+	encoder = &avroEncoder{w: w, archiveID: rc.ArchiveID, codec: avroCodec(rc.FileCompression)}
+	encoder.sync = make([]byte, 16)
+	_, err = rand.Read(encoder.sync)
+	if err != nil {
+		return nil, err
+	}
+	encoder.notefiles = map[string]*avroRecord{}
+	return encoder, nil
+}
+
+// InfersSchema returns true, because the schema of each notefile evolves with its events
+func (e *avroEncoder) InfersSchema() bool {
+	return true
+}
+
+// InferEvent adds any fields of an event's body that are new to its notefile's schema.
+// Fields are never removed and their kinds never change, so a field that is given a value
+// that can't be converted to its kind is widened to also hold strings, which the schema of
+// later files can still read earlier files by.  If a notefile's saved
+// schema can't be read, the archive fails rather than replacing the schema with one that
+// can't read earlier files.
+func (e *avroEncoder) InferEvent(event map[string]interface{}) {
+	body, isObject := event["body"].(map[string]interface{})
+	if !isObject {
+		return
+	}
+	notefileID, _ := event["file"].(string)
+	record, present := e.notefiles[notefileID]
+	if !present {
+		record = &avroRecord{}
+		recordJSON, err := os.ReadFile(avroSchemaPath(e.archiveID, notefileID))
+		if err == nil {
+			err = note.JSONUnmarshal(recordJSON, record)
+		}
+		if err != nil && !os.IsNotExist(err) && e.err == nil {
+			e.err = fmt.Errorf("can't read avro schema of %s: %s", notefileID, err)
+		}
+		e.notefiles[notefileID] = record
+	}
+	avroInferRecord(record, body)
+}
+
+// Add the new fields of an object to a record
+func avroInferRecord(record *avroRecord, object map[string]interface{}) {
+	keys := []string{}
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := object[key]
+		nested, isObject := value.(map[string]interface{})
+		var field *avroField
+		for _, existing := range record.Fields {
+			if existing.Key == key {
+				field = existing
+			}
+		}
+		if field != nil && !field.Widened && avroFieldConflicts(field, value) {
+			field.Widened = true
+		}
+		if field == nil {
+			kind := inferFieldKind(value)
+			if isObject {
+				kind = avroKindRecord
+			}
+			if kind == "" {
+				continue
+			}
+			field = &avroField{Name: avroName(key), Key: key, Kind: kind}
+			for avroRecordHasName(record, field.Name) {
+				field.Name += "_"
+			}
+			if isObject {
+				field.Record = &avroRecord{}
+			}
+			record.Fields = append(record.Fields, field)
+		}
+		if isObject && field.Kind == avroKindRecord {
+			avroInferRecord(field.Record, nested)
+		}
+	}
+}
+
+// Determine whether or not a field can't hold a value as its kind
+func avroFieldConflicts(field *avroField, value interface{}) bool {
+	if value == nil {
+		return false
+	}
+	if field.Kind == avroKindRecord {
+		_, isObject := value.(map[string]interface{})
+		return !isObject
+	}
+	return convertFieldValue(value, field.Kind) == nil
+}
+
+// Determine whether or not a record already has a field of the specified name
+func avroRecordHasName(record *avroRecord, name string) bool {
+	for _, field := range record.Fields {
+		if field.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Avro type of a field of the specified kind
+func avroType(kind string) interface{} {
+	switch kind {
+	case fieldKindDouble:
+		return "double"
+	case fieldKindInt64:
+		return "long"
+	case fieldKindTimestamp:
+		return map[string]interface{}{"type": "long", "logicalType": "timestamp-micros"}
+	case fieldKindBoolean:
+		return "boolean"
+	}
+	return "string"
+}
+
+// Schema of a nullable field, defaulting to null so that it may be added to later schemas
+func avroNullableField(name string, fieldType interface{}) map[string]interface{} {
+	return map[string]interface{}{"name": name, "type": []interface{}{"null", fieldType}, "default": nil}
+}
+
+// Schema of a record
+func avroRecordSchema(name string, record *avroRecord, names map[string]bool) map[string]interface{} {
+	fields := []interface{}{}
+	for _, field := range record.Fields {
+		var schema map[string]interface{}
+		if field.Kind == avroKindRecord {
+			schema = avroNullableField(field.Name, avroRecordSchema(avroUniqueName(name+"_"+field.Name, names), field.Record, names))
+		} else {
+			schema = avroNullableField(field.Name, avroType(field.Kind))
+		}
+		if field.Widened {
+			schema["type"] = append(schema["type"].([]interface{}), "string")
+		}
+		fields = append(fields, schema)
+	}
+	return map[string]interface{}{"type": "record", "name": name, "fields": fields}
+}
+
+// Reserve a unique name for a record
+func avroUniqueName(name string, names map[string]bool) string {
+	for names[name] {
+		name += "_"
+	}
+	names[name] = true
+	return name
+}
+
+// Save the schema of each notefile and write the file's header, once all events have been
+// inferred.  The body is a union of null and the records of the file's notefiles.
+func (e *avroEncoder) start() (err error) {
+
+	if e.err != nil {
+		return e.err
+	}
+	e.started = true
+	notefileIDs := []string{}
+	for notefileID, record := range e.notefiles {
+		notefileIDs = append(notefileIDs, notefileID)
+		recordJSON, err := note.JSONMarshal(record)
+		if err == nil {
+			err = writeFileAtomic(avroSchemaPath(e.archiveID, notefileID), recordJSON)
+		}
+		if err != nil {
+			return fmt.Errorf("can't save avro schema of %s: %s", notefileID, err)
+		}
+	}
+	sort.Strings(notefileIDs)
+
+	names := map[string]bool{"Event": true}
+	fields := []interface{}{}
+	for _, field := range eventEnvelopeFields {
+		if field.Column != "body" {
+			fields = append(fields, avroNullableField(field.Column, avroType(field.Kind)))
+		}
+	}
+	bodyTypes := []interface{}{"null"}
+	e.branches = map[string]int{}
+	for i, notefileID := range notefileIDs {
+		name := avroUniqueName(avroName(notefileID)+"_body", names)
+		bodyTypes = append(bodyTypes, avroRecordSchema(name, e.notefiles[notefileID], names))
+		e.branches[notefileID] = i + 1
+	}
+	fields = append(fields, map[string]interface{}{"name": "body", "type": bodyTypes, "default": nil})
+	schema := map[string]interface{}{"type": "record", "name": "Event", "namespace": avroNamespace, "fields": fields}
+	schemaJSON, err := note.JSONMarshal(schema)
+	if err != nil {
+		return err
+	}
+
+	header := []byte(avroMagic)
+	header = avroAppendLong(header, 2)
+	header = avroAppendBytes(header, []byte("avro.schema"))
+	header = avroAppendBytes(header, schemaJSON)
+	header = avroAppendBytes(header, []byte("avro.codec"))
+	header = avroAppendBytes(header, []byte(e.codec))
+	header = avroAppendLong(header, 0)
+	header = append(header, e.sync...)
+	_, err = e.w.Write(header)
+	return err
+
+}
+
+// Append a long, zigzag-encoded as a varint
+func avroAppendLong(buf []byte, v int64) []byte {
+	varint := make([]byte, binary.MaxVarintLen64)
+	return append(buf, varint[:binary.PutVarint(varint, v)]...)
+}
+
+// Append bytes or a string, preceded by its length
+func avroAppendBytes(buf []byte, b []byte) []byte {
+	return append(avroAppendLong(buf, int64(len(b))), b...)
+}
+
+// Append a nullable value of the specified kind, as the null or non-null branch of a union
+func avroAppendValue(buf []byte, value interface{}, kind string) []byte {
+	value = convertFieldValue(value, kind)
+	if value == nil {
+		return avroAppendLong(buf, 0)
+	}
+	buf = avroAppendLong(buf, 1)
+	switch v := value.(type) {
+	case string:
+		return avroAppendBytes(buf, []byte(v))
+	case int64:
+		return avroAppendLong(buf, v)
+	case float64:
+		bits := make([]byte, 8)
+		binary.LittleEndian.PutUint64(bits, math.Float64bits(v))
+		return append(buf, bits...)
+	case bool:
+		if v {
+			return append(buf, 1)
+		}
+		return append(buf, 0)
+	}
+	return buf
+}
+
+// Append the fields of an object as a record
+func avroAppendRecord(buf []byte, record *avroRecord, object map[string]interface{}) []byte {
+	for _, field := range record.Fields {
+		value := object[field.Key]
+		if field.Widened && avroFieldConflicts(field, value) {
+			s, _ := convertFieldValue(value, fieldKindString).(string)
+			buf = avroAppendLong(buf, 2)
+			buf = avroAppendBytes(buf, []byte(s))
+			continue
+		}
+		if field.Kind != avroKindRecord {
+			buf = avroAppendValue(buf, value, field.Kind)
+			continue
+		}
+		nested, isObject := value.(map[string]interface{})
+		if !isObject {
+			buf = avroAppendLong(buf, 0)
+			continue
+		}
+		buf = avroAppendLong(buf, 1)
+		buf = avroAppendRecord(buf, field.Record, nested)
+	}
+	return buf
+}
+
+// WriteEvent appends an event as a record
+func (e *avroEncoder) WriteEvent(event map[string]interface{}, eventJSON []byte) (err error) {
+	if !e.started {
+		err = e.start()
+		if err != nil {
+			return err
+		}
+	}
+	buf := []byte{}
+	for _, field := range eventEnvelopeFields {
+		if field.Column != "body" {
+			buf = avroAppendValue(buf, eventPathValue(event, field.Path), field.Kind)
+		}
+	}
+	body, isObject := event["body"].(map[string]interface{})
+	notefileID, _ := event["file"].(string)
+	branch, present := e.branches[notefileID]
+	if isObject && present {
+		buf = avroAppendLong(buf, int64(branch))
+		buf = avroAppendRecord(buf, e.notefiles[notefileID], body)
+	} else {
+		buf = avroAppendLong(buf, 0)
+	}
+	e.block.Write(buf)
+	e.count++
+	if e.block.Len() >= avroBlockBytes {
+		return e.flushBlock()
+	}
+	return nil
+}
+
+// Write the buffered records as a block
+func (e *avroEncoder) flushBlock() (err error) {
+	if e.count == 0 {
+		return nil
+	}
+	data, err := avroCompress(e.codec, e.block.Bytes())
+	if err != nil {
+		return err
+	}
+	header := avroAppendLong(nil, e.count)
+	header = avroAppendLong(header, int64(len(data)))
+	_, err = e.w.Write(header)
+	if err == nil {
+		_, err = e.w.Write(data)
+	}
+	if err == nil {
+		_, err = e.w.Write(e.sync)
+	}
+	e.block.Reset()
+	e.count = 0
+	return err
+}
+
+// Compress a block using the specified codec
+func avroCompress(codec string, block []byte) (compressed []byte, err error) {
+	switch codec {
+	case "null":
+		return block, nil
+	case "deflate":
+		buffer := &bytes.Buffer{}
+		compressor, err := flate.NewWriter(buffer, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		_, err = compressor.Write(block)
+		if err == nil {
+			err = compressor.Close()
+		}
+		return buffer.Bytes(), err
+	case "snappy":
+		compressed = snappy.Encode(nil, block)
+		checksum := make([]byte, 4)
+		binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(block))
+		return append(compressed, checksum...), nil
+	case "zstandard":
+		compressor, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer compressor.Close()
+		return compressor.EncodeAll(block, nil), nil
+	}
+	return nil, fmt.Errorf("avro: unsupported codec %s", codec)
+}
+
+// Close writes any buffered records
+func (e *avroEncoder) Close() (err error) {
+	if !e.started {
+		err = e.start()
+		if err != nil {
+			return err
+		}
+	}
+	return e.flushBlock()
+}
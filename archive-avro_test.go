@@ -0,0 +1,324 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/blues/note-go/note"
+	"github.com/klauspost/compress/zstd"
+	"github.com/linkedin/goavro/v2"
+)
+
+// Encode events as an Avro file
+func encodeTestAvro(t *testing.T, rc RouteConfig, eventsJSON []string) (file []byte, err error) {
+	var buffer bytes.Buffer
+	encoder, err := newAvroEncoder(rc, &buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []map[string]interface{}{}
+	for _, eventJSON := range eventsJSON {
+		var event map[string]interface{}
+		err = note.JSONUnmarshal([]byte(eventJSON), &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+		encoder.InferEvent(event)
+	}
+	for i, event := range events {
+		err = encoder.WriteEvent(event, []byte(eventsJSON[i]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = encoder.Close()
+	return buffer.Bytes(), err
+}
+
+// Rewrite a zstandard-compressed Avro file as an uncompressed one, decompressing each block
+// with an independent decoder, because goavro doesn't support the zstandard codec
+func decompressTestAvro(t *testing.T, file []byte) []byte {
+	reader := bytes.NewReader(file)
+	readLong := func() int64 {
+		v, err := binary.ReadVarint(reader)
+		if err != nil {
+			t.Fatalf("can't read avro file: %s", err)
+		}
+		return v
+	}
+	readBytes := func(n int64) []byte {
+		b := make([]byte, n)
+		_, err := reader.Read(b)
+		if err != nil && n > 0 {
+			t.Fatalf("can't read avro file: %s", err)
+		}
+		return b
+	}
+	magic := readBytes(int64(len(avroMagic)))
+	output := append([]byte{}, magic...)
+	metadata := map[string][]byte{}
+	for count := readLong(); count != 0; count = readLong() {
+		for i := int64(0); i < count; i++ {
+			key := string(readBytes(readLong()))
+			metadata[key] = readBytes(readLong())
+		}
+	}
+	if string(metadata["avro.codec"]) != "zstandard" {
+		t.Fatalf("expected zstandard codec, got %s", metadata["avro.codec"])
+	}
+	output = avroAppendLong(output, 2)
+	output = avroAppendBytes(output, []byte("avro.schema"))
+	output = avroAppendBytes(output, metadata["avro.schema"])
+	output = avroAppendBytes(output, []byte("avro.codec"))
+	output = avroAppendBytes(output, []byte("null"))
+	output = avroAppendLong(output, 0)
+	sync := readBytes(16)
+	output = append(output, sync...)
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	for reader.Len() > 0 {
+		count := readLong()
+		block, err := decoder.DecodeAll(readBytes(readLong()), nil)
+		if err != nil {
+			t.Fatalf("can't decompress block: %s", err)
+		}
+		if !bytes.Equal(readBytes(16), sync) {
+			t.Fatalf("block isn't followed by the sync marker")
+		}
+		output = avroAppendLong(output, count)
+		output = avroAppendBytes(output, block)
+		output = append(output, sync...)
+	}
+	return output
+}
+
+// Read the schema and records of an Avro file with an independent reader
+func readTestAvro(t *testing.T, file []byte) (schema map[string]interface{}, records []map[string]interface{}) {
+	ocfr, err := goavro.NewOCFReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("can't read avro file: %s", err)
+	}
+	err = note.JSONUnmarshal([]byte(ocfr.Codec().Schema()), &schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ocfr.Scan() {
+		datum, err := ocfr.Read()
+		if err != nil {
+			t.Fatalf("can't read avro record: %s", err)
+		}
+		records = append(records, datum.(map[string]interface{}))
+	}
+	if ocfr.Err() != nil {
+		t.Fatalf("can't read avro file: %s", ocfr.Err())
+	}
+	return schema, records
+}
+
+// Value of a nullable field, as decoded by goavro
+func avroTestValue(value interface{}) interface{} {
+	union, isUnion := value.(map[string]interface{})
+	if !isUnion || len(union) != 1 {
+		return value
+	}
+	for _, v := range union {
+		return v
+	}
+	return nil
+}
+
+// Fields of the body record of an Avro schema, by name
+func avroTestBodyFields(schema map[string]interface{}) (fields []interface{}) {
+	for _, field := range schema["fields"].([]interface{}) {
+		field := field.(map[string]interface{})
+		if field["name"] != "body" {
+			continue
+		}
+		for _, bodyType := range field["type"].([]interface{}) {
+			if record, isRecord := bodyType.(map[string]interface{}); isRecord {
+				fields = append(fields, record["fields"].([]interface{})...)
+			}
+		}
+	}
+	return fields
+}
+
+func TestAvroRoundTrip(t *testing.T) {
+	eventsJSON := []string{
+		`{"event":"e1","file":"data.qo","device":"dev:1","received":1656000000.5,"when":1656000000,"body":{"temp":21.5,"ok":true,"sensor":{"name":"a"}}}`,
+		`{"event":"e2","file":"data.qo","body":{"temp":22,"tags":[1,2]}}`,
+		`{"event":"e3","file":"data.qo"}`,
+	}
+	for _, compression := range []string{fileCompressionNone, fileCompressionDeflate, fileCompressionSnappy, fileCompressionZstd} {
+		t.Setenv("HOME", t.TempDir())
+		rc := RouteConfig{ArchiveID: "test", FileFormat: fileFormatAvro, FileCompression: compression}
+		file, err := encodeTestAvro(t, rc, eventsJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compression == fileCompressionZstd {
+			file = decompressTestAvro(t, file)
+		}
+		_, records := readTestAvro(t, file)
+		if len(records) != 3 {
+			t.Fatalf("%s: expected 3 records, got %d", compression, len(records))
+		}
+
+		expected := []map[string]interface{}{
+			{"event": "e1", "device": "dev:1", "received": time.UnixMicro(1656000000500000).UTC(), "when": int64(1656000000)},
+			{"event": "e2", "device": nil, "received": nil, "when": nil},
+			{"event": "e3", "device": nil, "received": nil, "when": nil},
+		}
+		for i, fields := range expected {
+			for name, value := range fields {
+				got := avroTestValue(records[i][name])
+				if !reflect.DeepEqual(got, value) {
+					t.Errorf("%s: expected record %d %s to be %v (%T), got %v (%T)", compression, i, name, value, value, got, got)
+				}
+			}
+		}
+
+		body, _ := avroTestValue(records[0]["body"]).(map[string]interface{})
+		if avroTestValue(body["temp"]) != 21.5 || avroTestValue(body["ok"]) != true {
+			t.Errorf("%s: unexpected body %v", compression, body)
+		}
+		sensor, _ := avroTestValue(body["sensor"]).(map[string]interface{})
+		if avroTestValue(sensor["name"]) != "a" {
+			t.Errorf("%s: unexpected sensor %v", compression, sensor)
+		}
+		body, _ = avroTestValue(records[1]["body"]).(map[string]interface{})
+		if avroTestValue(body["temp"]) != float64(22) || avroTestValue(body["tags"]) != "[1,2]" || body["ok"] != nil {
+			t.Errorf("%s: unexpected body %v", compression, body)
+		}
+		if records[2]["body"] != nil {
+			t.Errorf("%s: expected null body, got %v", compression, records[2]["body"])
+		}
+	}
+}
+
+func TestAvroSchemaEvolution(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	rc := RouteConfig{ArchiveID: "test", FileFormat: fileFormatAvro, FileCompression: fileCompressionDeflate}
+	os.MkdirAll(configDataPath(rc.ArchiveID), 0777)
+
+	// The second file's schema keeps the fields of the first, in the same order and of the
+	// same kinds, widening temp to also hold strings, and adds the new fields as nullable
+	// with a default of null
+	first, err := encodeTestAvro(t, rc, []string{`{"event":"e1","file":"data.qo","body":{"temp":21,"name":"a"}}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := encodeTestAvro(t, rc, []string{`{"event":"e2","file":"data.qo","body":{"humid":40,"temp":"hot"}}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstSchema, firstRecords := readTestAvro(t, first)
+	secondSchema, secondRecords := readTestAvro(t, second)
+	firstFields := avroTestBodyFields(firstSchema)
+	secondFields := avroTestBodyFields(secondSchema)
+	if len(firstFields) != 2 || len(secondFields) != 3 {
+		t.Fatalf("expected 2 and then 3 body fields, got %v and %v", firstFields, secondFields)
+	}
+	widened := firstFields[1].(map[string]interface{})
+	widened = map[string]interface{}{"name": widened["name"], "type": append(widened["type"].([]interface{}), "string"), "default": nil}
+	if !reflect.DeepEqual(secondFields[0], firstFields[0]) || !reflect.DeepEqual(secondFields[1], widened) {
+		t.Errorf("expected %v to begin with %v and %v", secondFields, firstFields[0], widened)
+	}
+	added := secondFields[2].(map[string]interface{})
+	if added["name"] != "humid" || added["default"] != nil || added["type"].([]interface{})[0] != "null" {
+		t.Errorf("expected humid to be added as nullable, got %v", added)
+	}
+
+	// Each file can be read by its own schema, and the value of a different kind than its
+	// field is held as a string
+	body := avroTestValue(firstRecords[0]["body"]).(map[string]interface{})
+	if avroTestValue(body["temp"]) != float64(21) || avroTestValue(body["name"]) != "a" {
+		t.Errorf("unexpected first body %v", body)
+	}
+	body = avroTestValue(secondRecords[0]["body"]).(map[string]interface{})
+	if avroTestValue(body["temp"]) != "hot" || body["name"] != nil || avroTestValue(body["humid"]) != float64(40) {
+		t.Errorf("unexpected second body %v", body)
+	}
+
+}
+
+func TestAvroCorruptSchema(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	rc := RouteConfig{ArchiveID: "test", FileFormat: fileFormatAvro}
+	os.MkdirAll(configDataPath(rc.ArchiveID+instanceAvroSchemas), 0777)
+	err := os.WriteFile(avroSchemaPath(rc.ArchiveID, "data.qo"), []byte("{"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A schema that can't be read fails the archive rather than being replaced
+	_, err = encodeTestAvro(t, rc, []string{`{"event":"e1","file":"data.qo","body":{"temp":21}}`})
+	if err == nil {
+		t.Errorf("expected a corrupt schema to fail the archive")
+	}
+	schemaJSON, _ := os.ReadFile(avroSchemaPath(rc.ArchiveID, "data.qo"))
+	if string(schemaJSON) != "{" {
+		t.Errorf("expected corrupt schema to be left alone, got %s", schemaJSON)
+	}
+}
+
+func TestAvroTypeConflicts(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	rc := RouteConfig{ArchiveID: "test", FileFormat: fileFormatAvro}
+	os.MkdirAll(configDataPath(rc.ArchiveID), 0777)
+
+	// Values that can't be held as the kind first seen for their field widen the field to
+	// also hold strings, rather than being lost
+	file, err := encodeTestAvro(t, rc, []string{
+		`{"event":"e1","file":"data.qo","body":{"temp":21,"sensor":{"name":"a"},"label":"x"}}`,
+		`{"event":"e2","file":"data.qo","body":{"temp":"hot","sensor":"broken","label":5}}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, records := readTestAvro(t, file)
+	for _, field := range avroTestBodyFields(schema) {
+		field := field.(map[string]interface{})
+		union := field["type"].([]interface{})
+		widened := union[len(union)-1] == "string" && len(union) == 3
+		if widened != (field["name"] == "temp" || field["name"] == "sensor") {
+			t.Errorf("unexpected type of %s: %v", field["name"], union)
+		}
+	}
+	body := avroTestValue(records[0]["body"]).(map[string]interface{})
+	sensor, _ := avroTestValue(body["sensor"]).(map[string]interface{})
+	if avroTestValue(body["temp"]) != float64(21) || avroTestValue(sensor["name"]) != "a" || avroTestValue(body["label"]) != "x" {
+		t.Errorf("unexpected first body %v", body)
+	}
+	body = avroTestValue(records[1]["body"]).(map[string]interface{})
+	if avroTestValue(body["temp"]) != "hot" || avroTestValue(body["sensor"]) != "broken" || avroTestValue(body["label"]) != "5" {
+		t.Errorf("unexpected second body %v", body)
+	}
+
+	// The widening is kept for later files, whose values of the field's kind are still held
+	// as that kind
+	file, err = encodeTestAvro(t, rc, []string{`{"event":"e3","file":"data.qo","body":{"temp":22}}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, records = readTestAvro(t, file)
+	if temp := avroTestBodyFields(schema)[2].(map[string]interface{}); temp["name"] != "temp" || len(temp["type"].([]interface{})) != 3 {
+		t.Errorf("expected temp to remain widened, got %v", temp)
+	}
+	body = avroTestValue(records[0]["body"]).(map[string]interface{})
+	if avroTestValue(body["temp"]) != float64(22) {
+		t.Errorf("unexpected third body %v", body)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Grouping of an archive's spooled segments into batches, one per folder, each of which is
+// archived as a single file once it is due
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A batch of events to be archived together, being all of the spooled events of a folder,
+// where Arrived is the time at which its oldest segment arrived on the server
+type archiveBatch struct {
+	Folder   string
+	Arrived  int64
+	First    int64
+	Last     int64
+	Count    int
+	Segments []spoolSegment
+}
+
+// Group segments into one batch per folder, sorted by folder, with the segments of each
+// batch sorted by the time of their first event.  Segments need not be supplied in order.
+func groupSegments(segments []spoolSegment) (batches []archiveBatch) {
+	batchIndex := map[string]int{}
+	for _, segment := range segments {
+		index, present := batchIndex[segment.Folder]
+		if !present {
+			index = len(batches)
+			batchIndex[segment.Folder] = index
+			batches = append(batches, archiveBatch{Folder: segment.Folder, Arrived: segment.Arrived, First: segment.First, Last: segment.Last})
+		}
+		batch := &batches[index]
+		batch.Segments = append(batch.Segments, segment)
+		batch.Count += segment.Count
+		if segment.Arrived < batch.Arrived {
+			batch.Arrived = segment.Arrived
+		}
+		if segment.First < batch.First {
+			batch.First = segment.First
+		}
+		if segment.Last > batch.Last {
+			batch.Last = segment.Last
+		}
+	}
+	for _, batch := range batches {
+		segments := batch.Segments
+		sort.SliceStable(segments, func(i, j int) bool {
+			return segments[i].First < segments[j].First
+		})
+	}
+	sort.Slice(batches, func(i, j int) bool {
+		return batches[i].Folder < batches[j].Folder
+	})
+	return batches
+}
+
+// ID of a batch, derived from the names of its segments so that it is the same each time the
+// batch is staged, and differs from that of every other batch because segments are named
+// uniquely
+func (batch archiveBatch) id() string {
+	names := []string{}
+	for _, segment := range batch.Segments {
+		names = append(names, segment.Name)
+	}
+	sort.Strings(names)
+	hash := sha256.Sum256([]byte(strings.Join(names, "\n")))
+	return hex.EncodeToString(hash[:8])
+}
+
+// Name of a batch's staging file and dead letter entry, being its folder followed by its ID.
+// The batch isn't named for its bucket key, which depends upon which of its events can be
+// encoded, and so isn't known until it has been staged.
+func (batch archiveBatch) stagedName() string {
+	return batch.Folder + " " + batch.id()
+}
+
+// Time at which a batch becomes due, which is when it has been spooled for the route's
+// maximum age, or immediately if it has reached the route's maximum count of events.  Age
+// is measured from when the batch arrived rather than from the times of its events, which
+// depend upon the route's time_basis, so that a batch of old events isn't archived as soon
+// as each event arrives.
+func (batch archiveBatch) dueTime(rc RouteConfig) time.Time {
+	if batch.Count >= rc.ArchiveCountExceeds {
+		return time.UnixMicro(batch.Arrived)
+	}
+	return time.UnixMicro(batch.Arrived).Add(time.Duration(rc.ArchiveEveryMins) * time.Minute)
+}
+
+// Age of a batch in minutes, being the time since it arrived
+func (batch archiveBatch) ageMins(now time.Time) int64 {
+	return int64(now.Sub(time.UnixMicro(batch.Arrived)) / time.Minute)
+}
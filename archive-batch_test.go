@@ -0,0 +1,265 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGroupSegmentsEmpty(t *testing.T) {
+	batches := groupSegments(nil)
+	if len(batches) != 0 {
+		t.Fatalf("expected no batches, got %d", len(batches))
+	}
+}
+
+func TestGroupSegmentsSingleFolder(t *testing.T) {
+
+	// The last folder must be emitted without needing a sentinel segment to terminate it
+	batches := groupSegments([]spoolSegment{
+		{Name: "a 300-2", Folder: "a", First: 300, Last: 400, Count: 2},
+		{Name: "a 100-1", Folder: "a", First: 100, Last: 500, Count: 3},
+	})
+	if len(batches) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(batches))
+	}
+	batch := batches[0]
+	if batch.Folder != "a" || batch.First != 100 || batch.Last != 500 || batch.Count != 5 {
+		t.Fatalf("unexpected batch %+v", batch)
+	}
+	if len(batch.Segments) != 2 || batch.Segments[0].Name != "a 100-1" || batch.Segments[1].Name != "a 300-2" {
+		t.Fatalf("segments not sorted by first event: %+v", batch.Segments)
+	}
+}
+
+func TestGroupSegmentsMultipleFolders(t *testing.T) {
+	batches := groupSegments([]spoolSegment{
+		{Name: "b 200-1", Folder: "b", First: 200, Last: 250, Count: 1},
+		{Name: "a 100-1", Folder: "a", First: 100, Last: 150, Count: 4},
+		{Name: "c 50-1", Folder: "c", First: 50, Last: 60, Count: 2},
+		{Name: "b 300-2", Folder: "b", First: 300, Last: 350, Count: 3},
+		{Name: "a b 10-1", Folder: "a b", First: 10, Last: 20, Count: 1},
+	})
+
+	expected := []struct {
+		folder   string
+		first    int64
+		last     int64
+		count    int
+		segments []string
+	}{
+		{"a", 100, 150, 4, []string{"a 100-1"}},
+		{"a b", 10, 20, 1, []string{"a b 10-1"}},
+		{"b", 200, 350, 4, []string{"b 200-1", "b 300-2"}},
+		{"c", 50, 60, 2, []string{"c 50-1"}},
+	}
+	if len(batches) != len(expected) {
+		t.Fatalf("expected %d batches, got %d", len(expected), len(batches))
+	}
+	for i, want := range expected {
+		batch := batches[i]
+		if batch.Folder != want.folder || batch.First != want.first || batch.Last != want.last || batch.Count != want.count {
+			t.Errorf("batch %d: expected %s %d-%d-%d, got %s %d-%d-%d", i,
+				want.folder, want.first, want.last, want.count, batch.Folder, batch.First, batch.Last, batch.Count)
+			continue
+		}
+		names := []string{}
+		for _, segment := range batch.Segments {
+			if segment.Folder != batch.Folder {
+				t.Errorf("batch %s contains segment of folder %s", batch.Folder, segment.Folder)
+			}
+			names = append(names, segment.Name)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(want.segments) {
+			t.Errorf("batch %s: expected segments %v, got %v", batch.Folder, want.segments, names)
+		}
+	}
+
+}
+
+func TestBatchDueTime(t *testing.T) {
+
+	// Age is measured from when the batch arrived, however old its events are
+	rc := RouteConfig{ArchiveEveryMins: 60, ArchiveCountExceeds: 10}
+	arrived := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	first := arrived.Add(-24 * time.Hour)
+	tests := []struct {
+		name  string
+		count int
+		now   time.Time
+		due   bool
+	}{
+		{"not yet due", 9, arrived.Add(59 * time.Minute), false},
+		{"due by age", 9, arrived.Add(60 * time.Minute), true},
+		{"due by count", 10, arrived.Add(time.Minute), true},
+	}
+	for _, test := range tests {
+		batch := archiveBatch{Folder: "a", Arrived: arrived.UnixMicro(), First: first.UnixMicro(), Last: first.UnixMicro(), Count: test.count}
+		due := !test.now.Before(batch.dueTime(rc))
+		if due != test.due {
+			t.Errorf("%s: expected due %v, got %v", test.name, test.due, due)
+		}
+	}
+}
+
+func TestPerformArchiveSkipsFoldersNotYetDue(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	spoolFolders = map[spoolFolderKey]*spoolFolder{}
+	spoolLoaded = map[string]bool{}
+
+	// Folder "a" is not yet due and sorts before folder "b", which is due by count, and
+	// folder "c", which is due by age because it arrived two hours ago.  Neither should be
+	// merged into, or blocked by, "a", even though the event in "a" is older than those in "b".
+	now := time.Now()
+	rc := RouteConfig{ArchiveID: "test", ArchiveEveryMins: 60, ArchiveCountExceeds: 2, FileFormat: "ndjson",
+		SinkType: sinkTypeFile, BucketName: "test", UploadMaxAttempts: 1, UploadTimeoutMins: 1}
+	err := writeRouteConfig(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cUs := now.Add(-2 * time.Hour).UnixMicro()
+	incomingPath := configDataPath(rc.ArchiveID + instanceIncomingEvents)
+	os.MkdirAll(incomingPath, 0777)
+	err = spoolWriteSegment(incomingPath, "c", []spoolRecord{{ReceivedUs: cUs, UIDHash: spoolUIDHash("c1"), EventJSON: []byte(`{"event":"c1"}`)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []struct {
+		folder     string
+		receivedUs int64
+		uid        string
+	}{
+		{"a", now.Add(-30 * time.Minute).UnixMicro(), "a1"},
+		{"b", now.Add(-time.Minute).UnixMicro(), "b1"},
+		{"b", now.UnixMicro(), "b2"},
+	}
+	for _, event := range events {
+		_, _, err = spoolAppend(rc.ArchiveID, event.folder, event.receivedUs, event.uid, []byte(fmt.Sprintf(`{"event":"%s"}`, event.uid)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	nextDue := performArchive(rc.ArchiveID)
+
+	// Folder "a" is due an hour after it arrived rather than an hour after its event's time
+	if nextDue.Before(now.Add(60*time.Minute)) || nextDue.After(time.Now().Add(60*time.Minute)) {
+		t.Errorf("expected next due an hour after %s, got %s", now, nextDue)
+	}
+	segments, err := spoolSegments(rc.ArchiveID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 || segments[0].Folder != "a" {
+		t.Errorf("expected only folder a to remain spooled, got %+v", segments)
+	}
+	sink, _ := newFileSink(rc)
+	objects, err := sink.ListObjects(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedKeys := map[string]bool{
+		fmt.Sprintf("b/%d-%d-2.ndjson", events[1].receivedUs, events[2].receivedUs):              true,
+		fmt.Sprintf("c/%d-%d-1.ndjson", cUs, cUs):                                                true,
+		manifestKey(fmt.Sprintf("b/%d-%d-2.ndjson", events[1].receivedUs, events[2].receivedUs)): true,
+		manifestKey(fmt.Sprintf("c/%d-%d-1.ndjson", cUs, cUs)):                                   true,
+	}
+	for _, object := range objects {
+		if !expectedKeys[object.Key] {
+			t.Errorf("unexpected object %s", object.Key)
+		}
+		delete(expectedKeys, object.Key)
+	}
+	for key := range expectedKeys {
+		t.Errorf("missing object %s", key)
+	}
+
+}
+
+func TestSpoolAppendSummarizesFolder(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	spoolFolders = map[spoolFolderKey]*spoolFolder{}
+	spoolLoaded = map[string]bool{}
+	os.MkdirAll(configDataPath("test"+instanceIncomingEvents), 0777)
+
+	// The batch reported for a folder covers every event spooled in it, and only in it, and
+	// arrived when its first event was appended, whatever the times of its events
+	now := time.Now()
+	rc := RouteConfig{ArchiveEveryMins: 60, ArchiveCountExceeds: 3}
+	appends := []struct {
+		folder     string
+		receivedUs int64
+		uid        string
+		count      int
+	}{
+		{"a", now.UnixMicro(), "a1", 1},
+		{"a", now.Add(-time.Hour).UnixMicro(), "a2", 2},
+		{"b", now.UnixMicro(), "b1", 1},
+		{"a", now.UnixMicro(), "a1", 2},
+		{"a", now.Add(time.Minute).UnixMicro(), "a3", 3},
+	}
+	arrived := map[string]int64{}
+	for _, test := range appends {
+		_, batch, err := spoolAppend("test", test.folder, test.receivedUs, test.uid, []byte(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if arrived[test.folder] == 0 {
+			arrived[test.folder] = batch.Arrived
+		}
+		if batch.Folder != test.folder || batch.Arrived != arrived[test.folder] || batch.Count != test.count {
+			t.Errorf("%s: expected arrival %d and count %d, got %+v", test.uid, arrived[test.folder], test.count, batch)
+		}
+		if batch.Arrived < now.UnixMicro() || batch.Arrived > time.Now().UnixMicro() {
+			t.Errorf("%s: expected arrival after %d, got %d", test.uid, now.UnixMicro(), batch.Arrived)
+		}
+	}
+
+	// Folder "a" is due immediately because it has reached the count, and "b" once it's aged
+	_, a, _ := spoolAppend("test", "a", now.UnixMicro(), "a3", []byte(`{}`))
+	if due := a.dueTime(rc); !due.Equal(time.UnixMicro(a.Arrived)) {
+		t.Errorf("expected a to be due at %s, got %s", time.UnixMicro(a.Arrived), due)
+	}
+	_, b, _ := spoolAppend("test", "b", now.UnixMicro(), "b1", []byte(`{}`))
+	if due := b.dueTime(rc); !due.Equal(time.UnixMicro(b.Arrived).Add(time.Hour)) {
+		t.Errorf("expected b to be due at %s, got %s", time.UnixMicro(b.Arrived).Add(time.Hour), due)
+	}
+
+	// Once a folder's segments are removed its state is dropped, so it starts afresh
+	segments, err := spoolSeal("test", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spoolRemove("test", "a", segments)
+	_, a, _ = spoolAppend("test", "a", now.UnixMicro(), "a1", []byte(`{}`))
+	if a.Arrived <= arrived["a"] || a.Count != 1 {
+		t.Errorf("expected a to restart with one event, got %+v", a)
+	}
+}
+
+func TestArchiveKeyBatchID(t *testing.T) {
+
+	// Only routes whose time_basis has a resolution of a second have the batch's ID in keys
+	batch := archiveBatch{Folder: "a b", Segments: []spoolSegment{{Name: "a b 100-1"}}}
+	info := stagedInfo{First: 100, Last: 200, Events: 3}
+	tests := []struct {
+		timeBasis string
+		key       string
+	}{
+		{"", "a/b/100-200-3.ndjson"},
+		{timeBasisReceived, "a/b/100-200-3.ndjson"},
+		{timeBasisWhen, "a/b/100-200-3-" + batch.id() + ".ndjson"},
+		{timeBasisRouted, "a/b/100-200-3-" + batch.id() + ".ndjson"},
+	}
+	for _, test := range tests {
+		key := archiveKey(RouteConfig{FileFormat: "ndjson", TimeBasis: test.timeBasis}, batch, info)
+		if key != test.key {
+			t.Errorf("%q: expected %s, got %s", test.timeBasis, test.key, key)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Encoding of events as CSV files, for loading into spreadsheets and warehouses.  The
+// columns are specified by the route's file_columns as paths into the event, and the file
+// begins with a header row naming them.  Values are quoted according to RFC 4180, and
+// strings that a spreadsheet would take to be formulas are prefixed with an apostrophe so
+// that opening an archive can't cause a device's data to be evaluated.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/blues/note-go/note"
+)
+
+// File format of CSV archives
+const fileFormatCSV = "csv"
+
+// Columns used when a route doesn't specify file_columns
+const defaultFileColumns = "event,device,sn,product,file,when,received,body"
+
+// Characters that begin a formula when they begin a spreadsheet cell, other than + and -,
+// which only do so when the cell isn't a number
+const csvFormulaPrefixes = "=@\t\r"
+const csvSignPrefixes = "+-"
+
+// Policies that may be specified in a route's file_formulas, for strings that a spreadsheet
+// would take to be formulas
+const fileFormulasKeep = "keep"
+const fileFormulasNeutralize = "neutralize"
+
+// Policies that may be specified in a route's file_missing, for events lacking a column
+const fileMissingEmpty = "empty"
+const fileMissingSkip = "skip"
+const fileMissingDeadLetter = "deadletter"
+
+// A column of a CSV file, and the path of the value within the event that it holds
+type csvColumn struct {
+	Name string
+	Path []string
+}
+
+// Parse file_columns, which is a comma-separated list of paths into the event, with the
+// names of nested fields separated by dots, such as "device,when,body.temp".  Each may be
+// preceded by a name for its column and an equals sign, such as "temp=body.temp", and
+// otherwise the column is named for its path.
+func parseCSVColumns(fileColumns string) (columns []csvColumn, err error) {
+	for _, declaration := range strings.Split(fileColumns, ",") {
+		column := csvColumn{}
+		path := declaration
+		equals := strings.Index(declaration, "=")
+		if equals != -1 {
+			column.Name = declaration[:equals]
+			path = declaration[equals+1:]
+		}
+		if column.Name == "" {
+			column.Name = path
+		}
+		column.Path = strings.Split(path, ".")
+		for _, name := range column.Path {
+			if name == "" {
+				return nil, fmt.Errorf("file_columns must be a comma-separated list of paths such as device,body.temp")
+			}
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+// Validate a missing field policy
+func validFileMissing(fileMissing string) (err error) {
+	switch fileMissing {
+	case fileMissingEmpty, fileMissingSkip, fileMissingDeadLetter:
+		return nil
+	}
+	return fmt.Errorf("file_missing must be empty, skip, or deadletter")
+}
+
+// Validate a formula policy
+func validFileFormulas(fileFormulas string) (err error) {
+	switch fileFormulas {
+	case fileFormulasKeep, fileFormulasNeutralize:
+		return nil
+	}
+	return fmt.Errorf("file_formulas must be keep or neutralize")
+}
+
+// Determine whether or not a spreadsheet would take a string to be a formula
+func csvIsFormula(s string) bool {
+	if s == "" {
+		return false
+	}
+	if strings.ContainsRune(csvSignPrefixes, rune(s[0])) {
+		_, err := strconv.ParseFloat(s, 64)
+		return err != nil
+	}
+	return strings.ContainsRune(csvFormulaPrefixes, rune(s[0]))
+}
+
+// Format a value for a CSV cell.  Strings are written as they are, unless they would be taken
+// to be formulas and are to be neutralized, numbers as they appeared in the event, and
+// objects and arrays as JSON.  Nulls are treated as missing.
+func csvFormat(value interface{}, neutralize bool) (cell string, present bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", false
+	case string:
+		if neutralize && csvIsFormula(v) {
+			return "'" + v, true
+		}
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		if v {
+			return "true", true
+		}
+		return "false", true
+	}
+	valueJSON, err := note.JSONMarshal(value)
+	if err != nil {
+		return "", false
+	}
+	return string(valueJSON), true
+}
+
+// Encoder for CSV files
+type csvEncoder struct {
+	w           *csv.Writer
+	columns     []csvColumn
+	fileMissing string
+	neutralize  bool
+}
+
+// Create a CSV encoder for the route's file_columns and file_missing, writing the header row
+func newCSVEncoder(rc RouteConfig, w io.Writer) (encoder *csvEncoder, err error) {
+	fileColumns := rc.FileColumns
+	if fileColumns == "" {
+		fileColumns = defaultFileColumns
+	}
+	encoder = &csvEncoder{w: csv.NewWriter(w), fileMissing: rc.FileMissing, neutralize: rc.FileFormulas == fileFormulasNeutralize}
+	if encoder.fileMissing == "" {
+		encoder.fileMissing = fileMissingEmpty
+	}
+	encoder.columns, err = parseCSVColumns(fileColumns)
+	if err != nil {
+		return nil, err
+	}
+	header := []string{}
+	for _, column := range encoder.columns {
+		header = append(header, column.Name)
+	}
+	err = encoder.w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return encoder, nil
+}
+
+// WriteEvent appends an event as a row, applying the missing field policy if it lacks any
+// of the columns
+func (e *csvEncoder) WriteEvent(event map[string]interface{}, eventJSON []byte) (err error) {
+	row := make([]string, len(e.columns))
+	for i, column := range e.columns {
+		cell, present := csvFormat(eventPathValue(event, column.Path), e.neutralize)
+		if !present {
+			switch e.fileMissing {
+			case fileMissingSkip:
+				return eventRejectedError{Reason: fmt.Sprintf("event lacks %s", strings.Join(column.Path, "."))}
+			case fileMissingDeadLetter:
+				return eventRejectedError{Reason: fmt.Sprintf("event lacks %s", strings.Join(column.Path, ".")), DeadLetter: true}
+			}
+		}
+		row[i] = cell
+	}
+	return e.w.Write(row)
+}
+
+// Close flushes the rows that have been written
+func (e *csvEncoder) Close() (err error) {
+	e.w.Flush()
+	return e.w.Error()
+}
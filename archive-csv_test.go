@@ -0,0 +1,199 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blues/note-go/note"
+)
+
+func TestParseCSVColumns(t *testing.T) {
+	tests := []struct {
+		fileColumns string
+		columns     []csvColumn
+		valid       bool
+	}{
+		{"device", []csvColumn{{"device", []string{"device"}}}, true},
+		{"device,body.temp", []csvColumn{{"device", []string{"device"}}, {"body.temp", []string{"body", "temp"}}}, true},
+		{"temp=body.temp", []csvColumn{{"temp", []string{"body", "temp"}}}, true},
+		{"=body.temp", []csvColumn{{"body.temp", []string{"body", "temp"}}}, true},
+		{"", nil, false},
+		{"device,", nil, false},
+		{"body..temp", nil, false},
+		{"temp=", nil, false},
+	}
+	for _, test := range tests {
+		columns, err := parseCSVColumns(test.fileColumns)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: expected valid %v, got %v", test.fileColumns, test.valid, err)
+			continue
+		}
+		if test.valid && !reflect.DeepEqual(columns, test.columns) {
+			t.Errorf("%q: expected %+v, got %+v", test.fileColumns, test.columns, columns)
+		}
+	}
+}
+
+func TestCSVFormat(t *testing.T) {
+	tests := []struct {
+		value      interface{}
+		neutralize bool
+		cell       string
+		present    bool
+	}{
+		{nil, false, "", false},
+		{"text", false, "text", true},
+		{"", false, "", true},
+		{jsonNumber("12.5"), false, "12.5", true},
+		{jsonNumber("-3"), false, "-3", true},
+		{true, false, "true", true},
+		{map[string]interface{}{"a": jsonNumber("1")}, false, `{"a":1}`, true},
+
+		// Strings that a spreadsheet would evaluate as formulas are written as they are
+		// unless they're to be neutralized, in which case numbers are still left alone
+		{"=1+2", false, "=1+2", true},
+		{"-05:00", false, "-05:00", true},
+		{"=1+2", true, "'=1+2", true},
+		{"+1 555 0100", true, "'+1 555 0100", true},
+		{"-A1", true, "'-A1", true},
+		{"@SUM(A1)", true, "'@SUM(A1)", true},
+		{"\t=1", true, "'\t=1", true},
+		{"a=1", true, "a=1", true},
+		{"-5", true, "-5", true},
+		{"+1.5e3", true, "+1.5e3", true},
+		{"-", true, "'-", true},
+	}
+	for _, test := range tests {
+		cell, present := csvFormat(test.value, test.neutralize)
+		if cell != test.cell || present != test.present {
+			t.Errorf("%v (neutralize %v): expected %q %v, got %q %v", test.value, test.neutralize, test.cell, test.present, cell, present)
+		}
+	}
+}
+
+// Number as it appears in a decoded event
+func jsonNumber(number string) interface{} {
+	var value interface{}
+	note.JSONUnmarshal([]byte(number), &value)
+	return value
+}
+
+func TestCSVFileMissing(t *testing.T) {
+	eventsJSON := []string{
+		`{"event":"e1","body":{"temp":21}}`,
+		`{"event":"e2","body":{}}`,
+		`{"event":"e3","body":{"temp":null}}`,
+	}
+	tests := []struct {
+		fileMissing string
+		rows        string
+		rejected    []string
+		deadLetter  bool
+	}{
+		{"", "event,temp\ne1,21\ne2,\ne3,\n", nil, false},
+		{fileMissingEmpty, "event,temp\ne1,21\ne2,\ne3,\n", nil, false},
+		{fileMissingSkip, "event,temp\ne1,21\n", []string{"e2", "e3"}, false},
+		{fileMissingDeadLetter, "event,temp\ne1,21\n", []string{"e2", "e3"}, true},
+	}
+	for _, test := range tests {
+		var file bytes.Buffer
+		rc := RouteConfig{FileFormat: fileFormatCSV, FileColumns: "event,temp=body.temp", FileMissing: test.fileMissing}
+		encoder, err := newCSVEncoder(rc, &file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rejected := []string{}
+		for _, eventJSON := range eventsJSON {
+			var event map[string]interface{}
+			note.JSONUnmarshal([]byte(eventJSON), &event)
+			err = encoder.WriteEvent(event, []byte(eventJSON))
+			if rejection, isRejected := err.(eventRejectedError); isRejected {
+				rejected = append(rejected, event["event"].(string))
+				if rejection.DeadLetter != test.deadLetter {
+					t.Errorf("%q: expected dead letter %v for %s", test.fileMissing, test.deadLetter, event["event"])
+				}
+				if !strings.Contains(rejection.Reason, "body.temp") {
+					t.Errorf("%q: expected reason to name body.temp, got %s", test.fileMissing, rejection.Reason)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = encoder.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file.String() != test.rows {
+			t.Errorf("%q: expected %q, got %q", test.fileMissing, test.rows, file.String())
+		}
+		if len(rejected) != len(test.rejected) || (len(rejected) > 0 && !reflect.DeepEqual(rejected, test.rejected)) {
+			t.Errorf("%q: expected %v to be rejected, got %v", test.fileMissing, test.rejected, rejected)
+		}
+	}
+}
+
+func TestArchiveKeyCountsEncodedEvents(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	spoolFolders = map[spoolFolderKey]*spoolFolder{}
+	spoolLoaded = map[string]bool{}
+
+	// Events that are rejected are neither counted in the key nor included in its time range
+	rc := RouteConfig{ArchiveID: "test", ArchiveEveryMins: 60, ArchiveCountExceeds: 3, FileFormat: fileFormatCSV,
+		FileColumns: "event,temp=body.temp", FileMissing: fileMissingDeadLetter, SinkType: sinkTypeFile, BucketName: "test",
+		UploadMaxAttempts: 1, UploadTimeoutMins: 1}
+	err := writeRouteConfig(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UnixMicro()
+	eventsJSON := []string{`{"event":"e1","body":{}}`, `{"event":"e2","body":{"temp":21}}`, `{"event":"e3","body":{}}`}
+	for i, eventJSON := range eventsJSON {
+		_, _, err = spoolAppend(rc.ArchiveID, "a", now+int64(i), fmt.Sprintf("e%d", i+1), []byte(eventJSON))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	performArchive(rc.ArchiveID)
+
+	sink, _ := newFileSink(rc)
+	key := fmt.Sprintf("a/%d-%d-1.csv", now+1, now+1)
+	_, exists, err := sink.GetObject(context.Background(), key)
+	if err != nil || !exists {
+		t.Errorf("expected %s to have been uploaded", key)
+	}
+	entries, err := deadLetterEntries(rc.ArchiveID)
+	if err != nil || len(entries) != 1 || entries[0].Count != 2 {
+		t.Errorf("expected one dead letter entry of 2 events, got %+v (%v)", entries, err)
+	}
+
+	// A batch none of whose events can be encoded is removed without being uploaded
+	_, _, err = spoolAppend(rc.ArchiveID, "b", now, "e4", []byte(`{"event":"e4","body":{}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		spoolAppend(rc.ArchiveID, "b", now+int64(i+1), fmt.Sprintf("e%d", i+5), []byte(`{"body":{}}`))
+	}
+	performArchive(rc.ArchiveID)
+	objects, _ := sink.ListObjects(context.Background(), "b/")
+	if len(objects) != 0 {
+		t.Errorf("expected nothing to be uploaded to b, got %+v", objects)
+	}
+	segments, _ := spoolSegments(rc.ArchiveID)
+	if len(segments) != 0 {
+		t.Errorf("expected no segments to remain spooled, got %+v", segments)
+	}
+	if _, err := os.Stat(configDataPath(rc.ArchiveID) + instanceRouteErrorFile); err == nil {
+		t.Errorf("expected no error to be recorded")
+	}
+}
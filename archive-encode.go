@@ -0,0 +1,244 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Streaming encoders for each of the supported archive file formats
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/blues/note-go/note"
+	"github.com/klauspost/compress/zstd"
+)
+
+// File formats that compress their own contents, rather than being compressed as a whole
+const fileFormatParquet = "parquet"
+
+// Compression types that may be specified in a route's file_compression
+const fileCompressionNone = "none"
+const fileCompressionGzip = "gzip"
+const fileCompressionZstd = "zstd"
+
+// archiveEncoder streams events, one at a time, into an archive being written
+type archiveEncoder interface {
+
+	// WriteEvent appends an event, supplied both in its decoded and raw JSON forms
+	WriteEvent(event map[string]interface{}, eventJSON []byte) (err error)
+
+	// Close terminates the archive, without closing the underlying writer
+	Close() (err error)
+}
+
+// Error returned by WriteEvent for an event that the encoder declines to encode, which is
+// moved to the dead letter directory if DeadLetter is set and is otherwise left out of the
+// archive, rather than failing the archive as a whole
+type eventRejectedError struct {
+	Reason     string
+	DeadLetter bool
+}
+
+// Error describes why the event was rejected
+func (e eventRejectedError) Error() string {
+	return e.Reason
+}
+
+// archiveSchemaEncoder is implemented by encoders whose schema depends upon the events being
+// archived, which are shown every event before the first is written
+type archiveSchemaEncoder interface {
+
+	// InfersSchema returns whether or not the schema depends upon the events, which it doesn't
+	// if it has been declared
+	InfersSchema() bool
+
+	// InferEvent updates the schema to accommodate an event
+	InferEvent(event map[string]interface{})
+}
+
+// Create an encoder for the route's file format
+func newArchiveEncoder(rc RouteConfig, w io.Writer) (encoder archiveEncoder, err error) {
+	fileFormat := rc.FileFormat
+	if fileFormat == fileFormatParquet {
+		return newParquetEncoder(rc, w)
+	}
+	if fileFormat == fileFormatCSV {
+		return newCSVEncoder(rc, w)
+	}
+	if fileFormat == fileFormatAvro {
+		return newAvroEncoder(rc, w)
+	}
+	if fileFormat == "array" {
+		return &jsonArrayEncoder{w: w, prefix: "", suffix: ""}, nil
+	}
+	if strings.HasPrefix(fileFormat, "object:") {
+		fieldName := strings.TrimPrefix(fileFormat, "object:")
+		fieldNameJSON, err := note.JSONMarshal(fieldName)
+		if err != nil {
+			return nil, fmt.Errorf("can't marshal field name: %s", err)
+		}
+		return &jsonArrayEncoder{w: w, prefix: "{" + string(fieldNameJSON) + ":", suffix: "}"}, nil
+	}
+	if fileFormat == "ndjson" {
+		return &ndjsonEncoder{w: w}, nil
+	}
+	return nil, fmt.Errorf("invalid file format: %s", fileFormat)
+}
+
+// Look up the value at the specified path within an event
+func eventPathValue(event map[string]interface{}, path []string) (value interface{}) {
+	value = event
+	for _, name := range path {
+		object, isObject := value.(map[string]interface{})
+		if !isObject {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
+
+// Suffix of archive object keys, reflecting their format, compression, and encryption
+func archiveFileSuffix(rc RouteConfig) (suffix string) {
+	suffix = ".json"
+	if rc.FileFormat == "ndjson" {
+		suffix = ".ndjson"
+	}
+	if rc.FileFormat == fileFormatParquet {
+		suffix = ".parquet"
+	}
+	if rc.FileFormat == fileFormatCSV {
+		suffix = ".csv"
+	}
+	if rc.FileFormat == fileFormatAvro {
+		suffix = ".avro"
+	}
+	switch archiveStreamCompression(rc) {
+	case fileCompressionGzip:
+		suffix += ".gz"
+	case fileCompressionZstd:
+		suffix += ".zst"
+	}
+	if rc.FilePublicKey != "" {
+		suffix += archiveEncryptedSuffix
+	}
+	return
+}
+
+// Content type and encoding of archive objects, for use as object metadata.  Encrypted
+// archives are opaque, so that clients don't attempt to decompress them.
+func archiveContentType(rc RouteConfig) (contentType string, contentEncoding string) {
+	if rc.FilePublicKey != "" {
+		return "application/octet-stream", ""
+	}
+	contentType = "application/json"
+	if rc.FileFormat == "ndjson" {
+		contentType = "application/x-ndjson"
+	}
+	if rc.FileFormat == fileFormatParquet {
+		contentType = "application/vnd.apache.parquet"
+	}
+	if rc.FileFormat == fileFormatCSV {
+		contentType = "text/csv"
+	}
+	if rc.FileFormat == fileFormatAvro {
+		contentType = "application/avro"
+	}
+	switch archiveStreamCompression(rc) {
+	case fileCompressionGzip:
+		contentEncoding = "gzip"
+	case fileCompressionZstd:
+		contentEncoding = "zstd"
+	}
+	return
+}
+
+// Compression applied to the archive as a whole, which is none for formats such as Parquet
+// and Avro that instead apply the route's file_compression to their contents
+func archiveStreamCompression(rc RouteConfig) string {
+	if rc.FileFormat == fileFormatParquet || rc.FileFormat == fileFormatAvro {
+		return fileCompressionNone
+	}
+	return rc.FileCompression
+}
+
+// No-op closer for writers that need no compression
+type nopWriteCloser struct {
+	io.Writer
+}
+
+// Close does nothing
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Create a writer that compresses what is written to it using the specified compression.
+// Closing the compressor flushes it without closing the underlying writer.
+func newArchiveCompressor(fileCompression string, w io.Writer) (compressor io.WriteCloser, err error) {
+	switch fileCompression {
+	case "", fileCompressionNone:
+		return nopWriteCloser{w}, nil
+	case fileCompressionGzip:
+		return gzip.NewWriter(w), nil
+	case fileCompressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("invalid file compression: %s", fileCompression)
+}
+
+// Encoder for a JSON array of events, optionally wrapped within an object
+type jsonArrayEncoder struct {
+	w      io.Writer
+	prefix string
+	suffix string
+	count  int
+}
+
+// WriteEvent appends an event as an element of the array
+func (e *jsonArrayEncoder) WriteEvent(event map[string]interface{}, eventJSON []byte) (err error) {
+	elementJSON, err := note.JSONMarshal(event)
+	if err != nil {
+		return fmt.Errorf("can't marshal event: %s", err)
+	}
+	separator := ","
+	if e.count == 0 {
+		separator = e.prefix + "["
+	}
+	_, err = io.WriteString(e.w, separator)
+	if err == nil {
+		_, err = e.w.Write(elementJSON)
+	}
+	e.count++
+	return
+}
+
+// Close terminates the array
+func (e *jsonArrayEncoder) Close() (err error) {
+	terminator := "]" + e.suffix
+	if e.count == 0 {
+		terminator = e.prefix + "[]" + e.suffix
+	}
+	_, err = io.WriteString(e.w, terminator)
+	return
+}
+
+// Encoder for newline-delimited JSON
+type ndjsonEncoder struct {
+	w io.Writer
+}
+
+// WriteEvent appends an event as a single line
+func (e *ndjsonEncoder) WriteEvent(event map[string]interface{}, eventJSON []byte) (err error) {
+	_, err = e.w.Write(eventJSON)
+	if err == nil {
+		_, err = io.WriteString(e.w, "\n")
+	}
+	return
+}
+
+// Close does nothing, because there is no trailer
+func (e *ndjsonEncoder) Close() (err error) {
+	return nil
+}
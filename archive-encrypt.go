@@ -0,0 +1,188 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Client-side encryption of archives, so that the bucket provider never sees their contents.
+// Each archive is encrypted with a random AES-256 key, which is itself encrypted with the
+// archive's RSA public key using OAEP and stored at the start of the object.  The object is:
+//
+//	"BAE1"
+//	length of the encrypted key (2 bytes, big-endian)
+//	encrypted key
+//	the archive, encrypted as a chunked AES-GCM stream
+//
+// Archives are decrypted with the matching private key, using the decrypt command.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Magic number at the start of an encrypted archive
+const archiveEncryptedMagic = "BAE1"
+
+// Suffix appended to the object keys of encrypted archives
+const archiveEncryptedSuffix = ".enc"
+
+// Minimum size of an RSA public key used to encrypt archives
+const archiveMinPublicKeyBits = 2048
+
+// Label bound to each encrypted archive key
+var archiveKeyLabel = []byte("archive")
+
+// Parse a public key supplied as base64-encoded DER, in either PKIX or PKCS#1 form
+func parseArchivePublicKey(publicKey string) (key *rsa.PublicKey, err error) {
+	der, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		der, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(publicKey, "="))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("file_public_key must be base64-encoded")
+	}
+	parsedKey, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		parsedKey, err = x509.ParsePKCS1PublicKey(der)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("file_public_key is not a DER-encoded public key")
+	}
+	key, isRSA := parsedKey.(*rsa.PublicKey)
+	if !isRSA {
+		return nil, fmt.Errorf("file_public_key must be an RSA public key")
+	}
+	if key.N.BitLen() < archiveMinPublicKeyBits {
+		return nil, fmt.Errorf("file_public_key must be at least %d bits", archiveMinPublicKeyBits)
+	}
+	return key, nil
+}
+
+// Create a writer that encrypts an archive using the specified public key, or that passes
+// the archive through unchanged if there is no key.  Closing the writer writes the end of the
+// encrypted archive without closing the underlying writer.
+func newArchiveEncrypter(publicKey string, w io.Writer) (encrypter io.WriteCloser, err error) {
+	if publicKey == "" {
+		return nopWriteCloser{w}, nil
+	}
+	rsaKey, err := parseArchivePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := cryptNewKey()
+	if err != nil {
+		return nil, err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaKey, key, archiveKeyLabel)
+	if err != nil {
+		return nil, fmt.Errorf("can't encrypt archive key: %s", err)
+	}
+	header := make([]byte, len(archiveEncryptedMagic)+2, len(archiveEncryptedMagic)+2+len(encryptedKey))
+	copy(header, archiveEncryptedMagic)
+	binary.BigEndian.PutUint16(header[len(archiveEncryptedMagic):], uint16(len(encryptedKey)))
+	header = append(header, encryptedKey...)
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return newCryptStreamWriter(w, key)
+}
+
+// Read an RSA private key from a PEM file, in either PKCS#8 or PKCS#1 form
+func readArchivePrivateKey(keyPath string) (key *rsa.PrivateKey, err error) {
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", keyPath)
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsedKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s does not contain a private key", keyPath)
+	}
+	key, isRSA := parsedKey.(*rsa.PrivateKey)
+	if !isRSA {
+		return nil, fmt.Errorf("%s does not contain an RSA private key", keyPath)
+	}
+	return key, nil
+}
+
+// Decrypt an archive using the private key in the specified PEM file.  If no output path
+// is specified, the archive is written alongside the input without its .enc suffix.
+func decryptArchive(keyPath string, inPath string, outPath string) (err error) {
+
+	if outPath == "" {
+		if !strings.HasSuffix(inPath, archiveEncryptedSuffix) {
+			return fmt.Errorf("output file must be specified unless input file ends with %s", archiveEncryptedSuffix)
+		}
+		outPath = strings.TrimSuffix(inPath, archiveEncryptedSuffix)
+	}
+	rsaKey, err := readArchivePrivateKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	// Decrypt the archive's key
+	in, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	header := make([]byte, len(archiveEncryptedMagic)+2)
+	_, err = in.ReadAt(header, 0)
+	if err != nil || string(header[:len(archiveEncryptedMagic)]) != archiveEncryptedMagic {
+		return fmt.Errorf("%s is not an encrypted archive", inPath)
+	}
+	encryptedKey := make([]byte, binary.BigEndian.Uint16(header[len(archiveEncryptedMagic):]))
+	_, err = in.ReadAt(encryptedKey, int64(len(header)))
+	if err != nil {
+		return fmt.Errorf("%s is not an encrypted archive", inPath)
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), nil, rsaKey, encryptedKey, archiveKeyLabel)
+	if err != nil {
+		return fmt.Errorf("can't decrypt archive key: %s", err)
+	}
+
+	// Decrypt the archive itself
+	streamOffset := int64(len(header) + len(encryptedKey))
+	streamSize := info.Size() - streamOffset
+	reader, err := newCryptStreamReader(io.NewSectionReader(in, streamOffset, streamSize), streamSize, key)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, io.NewSectionReader(reader, 0, reader.Size()))
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(outPath)
+		return err
+	}
+
+	fmt.Printf("decrypted %s to %s\n", inPath, outPath)
+	return nil
+
+}
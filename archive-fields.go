@@ -0,0 +1,146 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Fields of events, and the kinds of value that they hold, for formats such as Parquet and
+// Avro that hold each field in a typed column
+package main
+
+import (
+	"encoding/json"
+	"math"
+
+	"github.com/blues/note-go/note"
+)
+
+// Kinds of value that a field of an event may hold, which may be specified in a route's file_schema
+const fieldKindString = "string"
+const fieldKindDouble = "double"
+const fieldKindInt64 = "int64"
+const fieldKindBoolean = "boolean"
+const fieldKindJSON = "json"
+
+// Received times are held as timestamps, which may not be specified in a file_schema
+const fieldKindTimestamp = "timestamp"
+
+// A field of an event held by a column of an archive, and the path of its value within the event
+type eventField struct {
+	Column string
+	Path   []string
+	Kind   string
+}
+
+// The standard fields of the event envelope
+var eventEnvelopeFields = []eventField{
+	{"event", []string{"event"}, fieldKindString},
+	{"session", []string{"session"}, fieldKindString},
+	{"best_id", []string{"best_id"}, fieldKindString},
+	{"device", []string{"device"}, fieldKindString},
+	{"sn", []string{"sn"}, fieldKindString},
+	{"product", []string{"product"}, fieldKindString},
+	{"received", []string{"received"}, fieldKindTimestamp},
+	{"routed", []string{"routed"}, fieldKindInt64},
+	{"req", []string{"req"}, fieldKindString},
+	{"when", []string{"when"}, fieldKindInt64},
+	{"file", []string{"file"}, fieldKindString},
+	{"note", []string{"note"}, fieldKindString},
+	{"updates", []string{"updates"}, fieldKindInt64},
+	{"deleted", []string{"deleted"}, fieldKindBoolean},
+	{"queued", []string{"queued"}, fieldKindBoolean},
+	{"bulk", []string{"bulk"}, fieldKindBoolean},
+	{"payload", []string{"payload"}, fieldKindString},
+	{"best_location_type", []string{"best_location_type"}, fieldKindString},
+	{"best_lat", []string{"best_lat"}, fieldKindDouble},
+	{"best_lon", []string{"best_lon"}, fieldKindDouble},
+	{"best_location", []string{"best_location"}, fieldKindString},
+	{"best_country", []string{"best_country"}, fieldKindString},
+	{"best_timezone", []string{"best_timezone"}, fieldKindString},
+	{"where_olc", []string{"where_olc"}, fieldKindString},
+	{"where_when", []string{"where_when"}, fieldKindInt64},
+	{"where_lat", []string{"where_lat"}, fieldKindDouble},
+	{"where_lon", []string{"where_lon"}, fieldKindDouble},
+	{"where_location", []string{"where_location"}, fieldKindString},
+	{"where_country", []string{"where_country"}, fieldKindString},
+	{"where_timezone", []string{"where_timezone"}, fieldKindString},
+	{"tower_when", []string{"tower_when"}, fieldKindInt64},
+	{"tower_lat", []string{"tower_lat"}, fieldKindDouble},
+	{"tower_lon", []string{"tower_lon"}, fieldKindDouble},
+	{"tower_location", []string{"tower_location"}, fieldKindString},
+	{"tower_country", []string{"tower_country"}, fieldKindString},
+	{"tower_timezone", []string{"tower_timezone"}, fieldKindString},
+	{"voltage", []string{"voltage"}, fieldKindDouble},
+	{"temp", []string{"temp"}, fieldKindDouble},
+	{"body", []string{"body"}, fieldKindJSON},
+}
+
+// Infer the kind of a value, returning an empty kind if it is null and so says nothing
+func inferFieldKind(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return ""
+	case json.Number:
+		return fieldKindDouble
+	case bool:
+		return fieldKindBoolean
+	case string:
+		return fieldKindString
+	}
+	return fieldKindJSON
+}
+
+// Convert a value to the specified kind, returning nil if it can't be represented
+func convertFieldValue(value interface{}, kind string) interface{} {
+	if value == nil {
+		return nil
+	}
+	switch kind {
+	case fieldKindString:
+		switch v := value.(type) {
+		case string:
+			return v
+		case json.Number:
+			return v.String()
+		}
+		valueJSON, err := note.JSONMarshal(value)
+		if err != nil {
+			return nil
+		}
+		return string(valueJSON)
+	case fieldKindJSON:
+		valueJSON, err := note.JSONMarshal(value)
+		if err != nil {
+			return nil
+		}
+		return string(valueJSON)
+	case fieldKindDouble:
+		if number, isNumber := value.(json.Number); isNumber {
+			f, err := number.Float64()
+			if err == nil {
+				return f
+			}
+		}
+	case fieldKindInt64:
+		if number, isNumber := value.(json.Number); isNumber {
+			i, err := number.Int64()
+			if err == nil {
+				return i
+			}
+			f, err := number.Float64()
+			if err == nil && f == math.Trunc(f) && math.Abs(f) < math.MaxInt64 {
+				return int64(f)
+			}
+		}
+	case fieldKindBoolean:
+		if b, isBool := value.(bool); isBool {
+			return b
+		}
+	case fieldKindTimestamp:
+		if number, isNumber := value.(json.Number); isNumber {
+			f, err := number.Float64()
+			if err == nil {
+				return receivedAsInt64(f)
+			}
+		}
+	}
+	return nil
+}
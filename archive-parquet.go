@@ -0,0 +1,241 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Encoding of events as Parquet files.  Each event is a row having a column for each of the
+// standard fields of the event envelope, a body column holding the body as JSON, and a
+// column for each field of the flattened body, named body_ followed by the path of the field
+// with nested names separated by underscores.  The body columns are those declared in the
+// route's file_schema or, if there is none, are inferred from the events being archived.
+// The files are written by the parquet-go library, as flat schemas of optional columns.
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Prefix of the names of the columns holding fields of the body
+const parquetBodyPrefix = "body_"
+
+// Maximum number of body columns inferred for a file, beyond which further fields of the
+// body are held only within the body column, so that an unusual event having a great many
+// fields can't produce an unbounded schema
+const parquetMaxInferredColumns = 250
+
+// Size of buffered rows at which a row group is written
+const parquetRowGroupBytes = 16 * 1024 * 1024
+
+// Parse a file_schema, which is a comma-separated list of body fields each followed by a
+// colon and its kind, such as "temp:double,sensor.status:string".  Nested fields of the
+// body are separated by dots.
+func parseParquetSchema(schema string) (fields []eventField, err error) {
+	columns := map[string]bool{}
+	for _, declaration := range strings.Split(schema, ",") {
+		parts := strings.Split(declaration, ":")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("file_schema must be a comma-separated list of field:kind")
+		}
+		switch parts[1] {
+		case fieldKindString, fieldKindDouble, fieldKindInt64, fieldKindBoolean, fieldKindJSON:
+		default:
+			return nil, fmt.Errorf("file_schema kind of %s must be string, double, int64, boolean, or json", parts[0])
+		}
+		path := append([]string{"body"}, strings.Split(parts[0], ".")...)
+		field := eventField{Column: parquetBodyColumn(path[1:]), Path: path, Kind: parts[1]}
+		if columns[field.Column] {
+			return nil, fmt.Errorf("file_schema field %s is declared more than once", parts[0])
+		}
+		columns[field.Column] = true
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// Name of the column holding the body field with the specified path, within which any
+// character that isn't a letter, digit, or underscore is replaced by an underscore
+func parquetBodyColumn(path []string) string {
+	column := parquetBodyPrefix + strings.Join(path, "_")
+	return strings.Map(func(ch rune) rune {
+		if (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') || ch == '_' {
+			return ch
+		}
+		return '_'
+	}, column)
+}
+
+// Metadata of the Parquet column holding the values of a field, as understood by the
+// parquet-go library
+func parquetColumnOf(field eventField) string {
+	var columnType string
+	switch field.Kind {
+	case fieldKindDouble:
+		columnType = "type=DOUBLE"
+	case fieldKindInt64:
+		columnType = "type=INT64"
+	case fieldKindTimestamp:
+		columnType = "type=INT64, convertedtype=TIMESTAMP_MICROS"
+	case fieldKindBoolean:
+		columnType = "type=BOOLEAN"
+	case fieldKindJSON:
+		columnType = "type=BYTE_ARRAY, convertedtype=JSON"
+	default:
+		columnType = "type=BYTE_ARRAY, convertedtype=UTF8"
+	}
+	return fmt.Sprintf("name=%s, %s, repetitiontype=OPTIONAL", field.Column, columnType)
+}
+
+// Parquet codec implementing the route's file_compression
+func parquetCodec(fileCompression string) parquet.CompressionCodec {
+	switch fileCompression {
+	case fileCompressionGzip:
+		return parquet.CompressionCodec_GZIP
+	case fileCompressionZstd:
+		return parquet.CompressionCodec_ZSTD
+	}
+	return parquet.CompressionCodec_UNCOMPRESSED
+}
+
+// Encoder for Parquet files.  If the body columns aren't declared, they are inferred from
+// the events shown to InferEvent before the first event is written, keyed by the path of
+// each field, because distinct paths such as a.b and a_b may have the same column name.
+type parquetEncoder struct {
+	w          io.Writer
+	codec      parquet.CompressionCodec
+	bodyFields []eventField
+	inferred   map[string]eventField
+	fields     []eventField
+	writer     *writer.CSVWriter
+}
+
+// Create a Parquet encoder for the route's file_schema and file_compression
+func newParquetEncoder(rc RouteConfig, w io.Writer) (encoder *parquetEncoder, err error) {
+	encoder = &parquetEncoder{w: w, codec: parquetCodec(rc.FileCompression)}
+	if rc.FileSchema != "" {
+		encoder.bodyFields, err = parseParquetSchema(rc.FileSchema)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		encoder.inferred = map[string]eventField{}
+	}
+	return encoder, nil
+}
+
+// InfersSchema returns whether or not the body columns are inferred from the events, which
+// they are unless they were declared in the route's file_schema
+func (e *parquetEncoder) InfersSchema() bool {
+	return e.inferred != nil
+}
+
+// InferEvent adds the fields of an event's body to the inferred columns.  Numbers are
+// always doubles, so that the kind of a column doesn't depend upon whether or not the values
+// in a particular archive happen to be integers, and a field that holds values of different
+// kinds is held as a string.  Once parquetMaxInferredColumns fields have been inferred, no
+// further fields are added.
+func (e *parquetEncoder) InferEvent(event map[string]interface{}) {
+	if e.inferred == nil {
+		return
+	}
+	body, _ := event["body"].(map[string]interface{})
+	e.inferObject([]string{"body"}, body)
+}
+
+// Infer the columns of the fields of an object within the body
+func (e *parquetEncoder) inferObject(path []string, object map[string]interface{}) {
+	for name, value := range object {
+		fieldPath := append(append([]string{}, path...), name)
+		nested, isObject := value.(map[string]interface{})
+		if isObject {
+			e.inferObject(fieldPath, nested)
+			continue
+		}
+		kind := inferFieldKind(value)
+		key := strings.Join(fieldPath, "\x00")
+		field, present := e.inferred[key]
+		if !present && len(e.inferred) >= parquetMaxInferredColumns {
+			continue
+		}
+		if !present {
+			field = eventField{Path: fieldPath, Kind: kind}
+		} else if field.Kind == "" {
+			field.Kind = kind
+		} else if kind != "" && kind != field.Kind {
+			field.Kind = fieldKindString
+		}
+		e.inferred[key] = field
+	}
+}
+
+// Determine the columns of the file, once all events have been inferred.  Fields whose column
+// names collide are named in the order of their paths, each later one having underscores
+// appended until its name is unique, so that the names don't depend upon the order in which
+// the fields were inferred.
+func (e *parquetEncoder) start() (err error) {
+	if e.inferred != nil {
+		keys := []string{}
+		for key := range e.inferred {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		columns := map[string]bool{}
+		for _, key := range keys {
+			field := e.inferred[key]
+			if field.Kind == "" {
+				field.Kind = fieldKindString
+			}
+			field.Column = parquetBodyColumn(field.Path[1:])
+			for columns[field.Column] {
+				field.Column += "_"
+			}
+			columns[field.Column] = true
+			e.bodyFields = append(e.bodyFields, field)
+		}
+		sort.Slice(e.bodyFields, func(i, j int) bool {
+			return e.bodyFields[i].Column < e.bodyFields[j].Column
+		})
+	}
+	e.fields = append(append([]eventField{}, eventEnvelopeFields...), e.bodyFields...)
+	columns := []string{}
+	for _, field := range e.fields {
+		columns = append(columns, parquetColumnOf(field))
+	}
+	e.writer, err = writer.NewCSVWriterFromWriter(columns, e.w, 1)
+	if err != nil {
+		return fmt.Errorf("parquet: %s", err)
+	}
+	e.writer.CompressionType = e.codec
+	e.writer.RowGroupSize = parquetRowGroupBytes
+	return nil
+}
+
+// WriteEvent appends an event as a row
+func (e *parquetEncoder) WriteEvent(event map[string]interface{}, eventJSON []byte) (err error) {
+	if e.writer == nil {
+		err = e.start()
+		if err != nil {
+			return err
+		}
+	}
+	values := make([]interface{}, len(e.fields))
+	for i, field := range e.fields {
+		values[i] = convertFieldValue(eventPathValue(event, field.Path), field.Kind)
+	}
+	return e.writer.Write(values)
+}
+
+// Close writes the file's metadata
+func (e *parquetEncoder) Close() (err error) {
+	if e.writer == nil {
+		err = e.start()
+		if err != nil {
+			return err
+		}
+	}
+	return e.writer.WriteStop()
+}
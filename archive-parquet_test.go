@@ -0,0 +1,194 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/blues/note-go/note"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// Encode events as a Parquet file
+func encodeTestParquet(t *testing.T, rc RouteConfig, eventsJSON []string) []byte {
+	var file bytes.Buffer
+	encoder, err := newParquetEncoder(rc, &file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []map[string]interface{}{}
+	for _, eventJSON := range eventsJSON {
+		var event map[string]interface{}
+		err = note.JSONUnmarshal([]byte(eventJSON), &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+		if encoder.InfersSchema() {
+			encoder.InferEvent(event)
+		}
+	}
+	for i, event := range events {
+		err = encoder.WriteEvent(event, []byte(eventsJSON[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = encoder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file.Bytes()
+}
+
+// Read the columns of a Parquet file with an independent reader
+func readTestParquet(t *testing.T, file []byte) (columns map[string][]interface{}) {
+	source, err := buffer.NewBufferFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, err := reader.NewParquetColumnReader(source, 1)
+	if err != nil {
+		t.Fatalf("can't read parquet file: %s", err)
+	}
+	defer pr.ReadStop()
+	rows := pr.GetNumRows()
+	columns = map[string][]interface{}{}
+	for index, path := range pr.SchemaHandler.ValueColumns {
+		exPath := strings.Split(pr.SchemaHandler.InPathToExPath[path], common.PAR_GO_PATH_DELIMITER)
+		name := exPath[len(exPath)-1]
+		values, _, _, err := pr.ReadColumnByIndex(int64(index), rows)
+		if err != nil {
+			t.Fatalf("can't read column %s: %s", name, err)
+		}
+		columns[name] = values
+	}
+	return columns
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	eventsJSON := []string{
+		`{"event":"e1","device":"dev:1","received":1656000000.5,"when":1656000000,"deleted":true,"body":{"temp":21.5,"sensor":{"ok":true,"name":"a"}}}`,
+		`{"event":"e2","device":"dev:2","received":1656000001.25,"body":{"temp":22,"count":3}}`,
+		`{"event":"e3","body":{"temp":"hot"}}`,
+	}
+	for _, compression := range []string{fileCompressionNone, fileCompressionGzip, fileCompressionZstd} {
+		rc := RouteConfig{FileFormat: fileFormatParquet, FileCompression: compression}
+		columns := readTestParquet(t, encodeTestParquet(t, rc, eventsJSON))
+
+		expected := map[string][]interface{}{
+			"event":            {"e1", "e2", "e3"},
+			"device":           {"dev:1", "dev:2", nil},
+			"received":         {int64(1656000000500000), int64(1656000001250000), nil},
+			"when":             {int64(1656000000), nil, nil},
+			"deleted":          {true, nil, nil},
+			"body_temp":        {"21.5", "22", "hot"},
+			"body_count":       {nil, float64(3), nil},
+			"body_sensor_ok":   {true, nil, nil},
+			"body_sensor_name": {"a", nil, nil},
+		}
+		for name, values := range expected {
+			got, present := columns[name]
+			if !present {
+				t.Errorf("%s: expected column %s", compression, name)
+				continue
+			}
+			if len(got) != len(values) {
+				t.Errorf("%s: expected %d values in %s, got %v", compression, len(values), name, got)
+				continue
+			}
+			for i := range values {
+				if got[i] != values[i] {
+					t.Errorf("%s: expected %s row %d to be %v (%T), got %v (%T)", compression, name, i, values[i], values[i], got[i], got[i])
+				}
+			}
+		}
+	}
+}
+
+func TestParquetDeclaredSchema(t *testing.T) {
+	rc := RouteConfig{FileFormat: fileFormatParquet, FileSchema: "temp:int64,sensor.name:string"}
+	encoder, err := newParquetEncoder(rc, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoder.InfersSchema() {
+		t.Errorf("expected a declared schema not to be inferred")
+	}
+	columns := readTestParquet(t, encodeTestParquet(t, rc, []string{`{"event":"e1","body":{"temp":21,"other":1,"sensor":{"name":"a"}}}`}))
+	if len(columns["body_temp"]) != 1 || columns["body_temp"][0] != int64(21) {
+		t.Errorf("expected body_temp of 21, got %v", columns["body_temp"])
+	}
+	if len(columns["body_sensor_name"]) != 1 || columns["body_sensor_name"][0] != "a" {
+		t.Errorf("expected body_sensor_name of a, got %v", columns["body_sensor_name"])
+	}
+	if _, present := columns["body_other"]; present {
+		t.Errorf("expected undeclared field not to have a column")
+	}
+}
+
+func TestParquetColumnCollisions(t *testing.T) {
+
+	// Fields whose column names collide are named by the order of their paths, in which a.b
+	// precedes a-b and a_b, regardless of the order in which they appear
+	eventsJSON := []string{`{"body":{"a_b":2,"a-b":3}}`, `{"body":{"a":{"b":1}}}`}
+	for _, order := range [][]string{eventsJSON, {eventsJSON[1], eventsJSON[0]}} {
+		columns := readTestParquet(t, encodeTestParquet(t, RouteConfig{FileFormat: fileFormatParquet}, order))
+		first := 0
+		if order[0] != eventsJSON[0] {
+			first = 1
+		}
+		expected := map[string]float64{"body_a_b": 1, "body_a_b_": 3, "body_a_b__": 2}
+		for name, value := range expected {
+			values := columns[name]
+			if len(values) != 2 {
+				t.Fatalf("expected column %s with 2 values, got %v", name, values)
+			}
+			if values[first] != value && values[1-first] != value {
+				t.Errorf("expected %s to hold %v, got %v", name, value, values)
+			}
+		}
+	}
+
+}
+
+func TestParquetInferredColumnLimit(t *testing.T) {
+
+	// Fields beyond the limit are held only within the body column
+	fields := []string{}
+	for i := 0; i < parquetMaxInferredColumns+10; i++ {
+		fields = append(fields, fmt.Sprintf(`"f%03d":%d`, i, i))
+	}
+	eventsJSON := []string{`{"body":{"temp":1}}`, `{"body":{` + strings.Join(fields, ",") + `}}`}
+	columns := readTestParquet(t, encodeTestParquet(t, RouteConfig{FileFormat: fileFormatParquet}, eventsJSON))
+	bodyColumns := 0
+	for name := range columns {
+		if strings.HasPrefix(name, parquetBodyPrefix) {
+			bodyColumns++
+		}
+	}
+	if bodyColumns != parquetMaxInferredColumns {
+		t.Errorf("expected %d body columns, got %d", parquetMaxInferredColumns, bodyColumns)
+	}
+	if values := columns["body_temp"]; len(values) != 2 || values[0] != float64(1) {
+		t.Errorf("expected body_temp to be inferred first, got %v", values)
+	}
+	if values := columns["body"]; len(values) != 2 || !strings.Contains(values[1].(string), `"f259":259`) {
+		t.Errorf("expected the body column to hold every field")
+	}
+
+}
+
+func TestParquetEmpty(t *testing.T) {
+	columns := readTestParquet(t, encodeTestParquet(t, RouteConfig{FileFormat: fileFormatParquet}, nil))
+	if values, present := columns["event"]; !present || len(values) != 0 {
+		t.Errorf("expected an empty event column, got %v", values)
+	}
+}
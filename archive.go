@@ -5,149 +5,277 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/blues/note-go/note"
 	"github.com/google/uuid"
 )
 
-// Event indicating that something happened
-var archiveIncoming *Event
-
-// Handler that performs archiving in a way that's serialized on the archive.  In theory
-// we could parallelize this quite easily by using a goroutine, however we might consume
-// quite a bit of memory so we'll just keep it serialized for now.
+// Event indicating that something happened, waking the scheduler
+var archiveIncoming = EventNew()
+
+// Environment variable specifying how many archives may be processed concurrently
+const archiveConcurrencyEnv = "ARCHIVE_CONCURRENCY"
+const defaultArchiveConcurrency = 4
+
+// How often every archive is processed regardless of its schedule, as a safety net
+const archiveRescanPeriod = time.Duration(1) * time.Hour
+
+// States of an archive within the work queue
+const archiveQueued = 1
+const archiveRunning = 2
+const archiveRerun = 3
+
+// Work queue of archives to be processed, in which each archive appears at most once so
+// that an archive is never processed by more than one worker at a time, along with the
+// time at which each archive next has a folder due, and the archives that have had events
+// requeued since they were last processed.  All are protected by the lock.
+var archiveQueueLock sync.Mutex
+var archiveQueueReady = sync.NewCond(&archiveQueueLock)
+var archiveQueue []string
+var archiveStates = map[string]int{}
+var archiveDue = map[string]time.Time{}
+var archivePending = map[string]bool{}
+
+// Handler that schedules archiving.  Archives are processed concurrently by a pool of workers
+// so that a slow or unreachable bucket only delays its own archive, while the size of the
+// pool bounds the memory and disk bandwidth consumed.  Rather than polling, the scheduler
+// sleeps until the earliest time at which any archive has a folder due, which it learns of
+// as events are spooled, and then processes only the archives that are due or that have
+// had events requeued, so that an archive is not re-read for every event that it receives.
 func archiveHandler() {
 
-	// Initialize the queue
-	archiveIncoming = EventNew()
+	// Start the workers
+	concurrency, err := strconv.Atoi(os.Getenv(archiveConcurrencyEnv))
+	if err != nil || concurrency < 1 {
+		concurrency = defaultArchiveConcurrency
+	}
+	for i := 0; i < concurrency; i++ {
+		go archiveWorker()
+	}
 
-	// Loop, performing archives
+	// Loop, queueing archives for the workers
+	lastRescan := time.Time{}
 	for {
 
-		// Read all archive IDs
-		dataDir, _ := os.Open(configDataPath(""))
-		archiveIDFiles, err := dataDir.ReadDir(0)
-		dataDir.Close()
-		if err != nil {
-			fmt.Printf("data directory read error: %s\n", err)
-		} else {
-			for _, archiveIDFile := range archiveIDFiles {
-				performArchive(archiveIDFile.Name())
+		// Periodically process every archive, including at startup
+		now := time.Now()
+		if now.Sub(lastRescan) >= archiveRescanPeriod {
+			lastRescan = now
+			dataDir, _ := os.Open(configDataPath(""))
+			archiveIDFiles, err := dataDir.ReadDir(0)
+			dataDir.Close()
+			if err != nil {
+				fmt.Printf("data directory read error: %s\n", err)
+			} else {
+				for _, archiveIDFile := range archiveIDFiles {
+					if archiveIDFile.IsDir() {
+						archiveSchedule(archiveIDFile.Name())
+					}
+				}
 			}
 		}
 
-		// Wait until something comes in
-		archiveIncoming.Wait(time.Duration(1) * time.Hour)
+		// Process archives that are due or that have requeued events, and find the earliest
+		// time at which another archive will become due
+		wakeAt := lastRescan.Add(archiveRescanPeriod)
+		archiveQueueLock.Lock()
+		scheduled := []string{}
+		for archiveID := range archivePending {
+			scheduled = append(scheduled, archiveID)
+		}
+		archivePending = map[string]bool{}
+		for archiveID, due := range archiveDue {
+			if !due.After(now) {
+				scheduled = append(scheduled, archiveID)
+				delete(archiveDue, archiveID)
+			} else if due.Before(wakeAt) {
+				wakeAt = due
+			}
+		}
+		archiveQueueLock.Unlock()
+		for _, archiveID := range scheduled {
+			archiveSchedule(archiveID)
+		}
+
+		// Wait until something comes in, or until the earliest deadline
+		archiveIncoming.Wait(time.Until(wakeAt))
 
 	}
 
 }
 
-// Process a single archive, by ID
-func performArchive(archiveID string) {
-	var rc RouteConfig
+// Note that an archive has a folder that becomes due at the specified time, waking the
+// scheduler if that's earlier than it knew of, so that it may process the archive then
+func archiveNotifyDue(archiveID string, due time.Time) {
+	archiveQueueLock.Lock()
+	existing, present := archiveDue[archiveID]
+	earlier := !present || due.Before(existing)
+	if earlier {
+		archiveDue[archiveID] = due
+	}
+	archiveQueueLock.Unlock()
+	if earlier {
+		archiveIncoming.Signal()
+	}
+}
 
-	// First, to save memory because file descriptors are large, gather directory
-	// entries incrementally as a string array, and then sort the array.
-	dataDir, err := os.Open(configDataPath(archiveID + instanceIncomingEvents))
-	if err != nil {
-		fmt.Printf("can't open incoming events for %s: %s\n", archiveID, err)
-		return
+// Note that an archive has events that should be processed now, such as those that have
+// been requeued, and wake the scheduler to process it
+func archiveNotify(archiveID string) {
+	archiveQueueLock.Lock()
+	archivePending[archiveID] = true
+	archiveQueueLock.Unlock()
+	archiveIncoming.Signal()
+}
+
+// Queue an archive to be processed.  If it is already being processed, it is processed again
+// when finished, because it may have been queued in response to newly-arrived events.
+func archiveSchedule(archiveID string) {
+	archiveQueueLock.Lock()
+	defer archiveQueueLock.Unlock()
+	switch archiveStates[archiveID] {
+	case archiveQueued, archiveRerun:
+	case archiveRunning:
+		archiveStates[archiveID] = archiveRerun
+	default:
+		archiveStates[archiveID] = archiveQueued
+		archiveQueue = append(archiveQueue, archiveID)
+		archiveQueueReady.Signal()
 	}
-	filenames := []string{}
+}
+
+// Worker that processes queued archives
+func archiveWorker() {
 	for {
-		files, err := dataDir.ReadDir(1)
-		if err != nil {
-			break
+
+		archiveQueueLock.Lock()
+		for len(archiveQueue) == 0 {
+			archiveQueueReady.Wait()
 		}
-		for _, file := range files {
-			filename := file.Name()
-			if !strings.HasPrefix(filename, ".") {
-				filenames = append(filenames, filename)
-			}
+		archiveID := archiveQueue[0]
+		archiveQueue = archiveQueue[1:]
+		archiveStates[archiveID] = archiveRunning
+		delete(archiveDue, archiveID)
+		archiveQueueLock.Unlock()
+
+		nextDue := performArchive(archiveID)
+
+		// Record when the archive is next due, unless events spooled while it was being
+		// processed made it due sooner, waking the scheduler so that it may sleep until then
+		archiveQueueLock.Lock()
+		due, present := archiveDue[archiveID]
+		if !nextDue.IsZero() && (!present || nextDue.Before(due)) {
+			archiveDue[archiveID] = nextDue
 		}
+		if archiveStates[archiveID] == archiveRerun {
+			archiveStates[archiveID] = archiveQueued
+			archiveQueue = append(archiveQueue, archiveID)
+			archiveQueueReady.Signal()
+		} else {
+			delete(archiveStates, archiveID)
+		}
+		archiveQueueLock.Unlock()
+		archiveIncoming.Signal()
+
 	}
-	dataDir.Close()
-	sort.Strings(filenames)
-	if len(filenames) == 0 {
+}
+
+// Process a single archive, by ID, returning the earliest time at which a folder that
+// remains spooled will become due, or zero if none will become due without new events
+func performArchive(archiveID string) (nextDue time.Time) {
+
+	// First, gather the archive's spooled segments, grouped into a batch per folder
+	segments, err := spoolSegments(archiveID)
+	if err != nil {
+		fmt.Printf("can't open incoming events for %s: %s\n", archiveID, err)
+		return
+	}
+	batches := groupSegments(segments)
+	pendingManifests, _ := readPendingManifests(archiveID)
+	if len(batches) == 0 && len(pendingManifests) == 0 {
 		return
 	}
 
-	// Append a special filename to ensure that we terminate cleanly
-	filenames = append(filenames, "completed -1")
+	// Read the route config
+	rc, err := archiveRouteConfig(archiveID)
+	if err != nil {
+		fmt.Printf("can't read %s config: %s\n", archiveID, err)
+		return
+	}
 
-	// Next, iterate over the sorted filenames
-	prevFolder := ""
-	prevFiles := []string{}
-	prevTime := int64(0)
-	lastTime := int64(0)
+	// List archives whose manifest updates failed on an earlier pass
+	err = retryPendingManifests(rc)
+	if err != nil {
+		fmt.Printf("archive: %s: %s\n", rc.ArchiveID, err)
+	}
 
-	// Accumulate filenames for a given folder
-	for _, filename := range filenames {
+	// Archive each folder that is due
+	for _, batch := range batches {
 
-		// Parse the filename into folder and time
-		index := strings.LastIndex(filename, " ")
-		if index == -1 {
-			continue
-		}
-		thisFolder := filename[:index]
-		thisTime, _ := strconv.ParseInt(filename[index+1:], 10, 0)
-		if thisTime == 0 {
+		// If the time has expired OR the count is excessive, do it
+		now := time.Now()
+		dueTime := batch.dueTime(rc)
+		if now.Before(dueTime) {
+			nextDue = earliestTime(nextDue, dueTime)
+			fmt.Printf("archive: %s folder '%s' is %d mins old and has %d events (will archive at %d mins or %d events)\n",
+				rc.ArchiveID, batch.Folder, batch.ageMins(now), batch.Count, rc.ArchiveEveryMins, rc.ArchiveCountExceeds)
 			continue
 		}
 
-		// Special case for the first folder
-		if prevFolder == "" {
-			prevFolder = thisFolder
-			prevTime = thisTime
-			lastTime = thisTime
-		}
-
-		// If this is the same as the previous folder, just add the filename to the list
-		if prevFolder == thisFolder {
-			prevFiles = append(prevFiles, configDataPath(archiveID+instanceIncomingEvents)+filename)
-			lastTime = thisTime
+		// Don't retry a folder whose upload failed until its backoff has elapsed
+		retryAfter := folderRetryAfter(archiveID, batch.Folder)
+		if now.Before(retryAfter) {
+			nextDue = earliestTime(nextDue, retryAfter)
+			fmt.Printf("archive: %s folder '%s' will be retried at %s\n", rc.ArchiveID, batch.Folder, retryAfter.Format(time.RFC3339))
 			continue
 		}
 
-		// Read the route config if it hasn't yet been read
-		if rc.ArchiveID == "" {
-			rcJSON, err := os.ReadFile(configDataPath(archiveID) + instanceRouteConfigFile)
-			if err != nil {
-				fmt.Printf("can't read %s config file: %s\n", archiveID, err)
-				continue
-			}
-			err = note.JSONUnmarshal(rcJSON, &rc)
-			if err != nil {
-				continue
-			}
-		}
-
-		// If the time has expired OR the count is excessive, do it
-		nowUs := time.Now().UnixNano() / 1000
-		elapsedMins := ((nowUs - prevTime) / 1000000) / 60
-		if elapsedMins < int64(rc.ArchiveEveryMins) && len(prevFiles) < rc.ArchiveCountExceeds {
-			fmt.Printf("archive: %s folder '%s' is %d mins old and has %d events (will archive at %d mins or %d events)\n",
-				rc.ArchiveID, prevFolder, elapsedMins, len(prevFiles), rc.ArchiveEveryMins, rc.ArchiveCountExceeds)
+		// Seal the folder's segments so that events arriving during the upload are appended
+		// to a new segment, and archive everything in the sealed segments
+		sealedSegments, err := spoolSeal(archiveID, batch.Folder)
+		sealedBatches := groupSegments(sealedSegments)
+		if err != nil || len(sealedBatches) != 1 {
+			fmt.Printf("archive: %s can't seal folder '%s': %v\n", rc.ArchiveID, batch.Folder, err)
 			continue
 		}
+		batch = sealedBatches[0]
 
-		// Upload the archive, and either set or delete the error file
-		archiveBucketKey := fmt.Sprintf("%s/%d-%d-%d.json", strings.ReplaceAll(prevFolder, " ", "/"), prevTime, lastTime, len(prevFiles))
-		err = uploadArchive(rc, archiveBucketKey, prevFiles)
+		// Upload the archive, and either set or delete the error file.  If the upload fails,
+		// it is retried after a backoff, until it has failed too many times, at which point
+		// the batch is moved to the dead letter directory.
+		err = uploadArchive(rc, batch)
 		errFilePath := configDataPath(rc.ArchiveID) + instanceRouteErrorFile
 		if err != nil {
 			fmt.Printf("error uploading to %s: %s\n", rc.ArchiveID, err)
+			attempts, nextAttempt := folderUploadFailed(archiveID, batch.Folder, err)
+			if attempts < rc.UploadMaxAttempts {
+				nextDue = earliestTime(nextDue, nextAttempt)
+				fmt.Printf("archive: %s folder '%s' failed %d of %d attempts, will retry at %s\n",
+					rc.ArchiveID, batch.Folder, attempts, rc.UploadMaxAttempts, nextAttempt.Format(time.RFC3339))
+			} else {
+				abandonUpload(rc, batch)
+				reason := fmt.Sprintf("upload failed %d times: %s", attempts, err)
+				deadErr := deadLetterBatch(archiveID, batch.Folder, batch.stagedName(), batch.Segments, reason)
+				if deadErr != nil {
+					fmt.Printf("archive: %s: %s\n", rc.ArchiveID, deadErr)
+				} else {
+					folderRetryClear(archiveID, batch.Folder)
+					err = fmt.Errorf("%s (moved to dead letter after %d attempts)", err, attempts)
+				}
+			}
 			errBytes := []byte(err.Error())
 			tempFile := uuid.New().String() + ".temp"
 			tempPath := configDataPath(rc.ArchiveID) + tempFile
@@ -157,112 +285,366 @@ func performArchive(archiveID string) {
 			}
 		} else {
 
-			// Remove the error file
+			// Remove the error file and the folder's retry state
 			os.Remove(errFilePath)
+			folderRetryClear(archiveID, batch.Folder)
 
-			// Remove the successfully-archived files
-			for _, filepath := range prevFiles {
-				os.Remove(filepath)
-			}
+			// Remove the successfully-archived segments
+			spoolRemove(archiveID, batch.Folder, batch.Segments)
 
-			fmt.Printf("archive: %s folder '%s' (%d events) archived\n", rc.ArchiveID, prevFolder, len(prevFiles))
+			fmt.Printf("archive: %s folder '%s' (%d events) archived\n", rc.ArchiveID, batch.Folder, batch.Count)
 
 		}
 
-		// Move on to the next folder
-		if thisTime == -1 {
-			break
-		}
-		prevFolder = thisFolder
-		prevTime = thisTime
-		lastTime = int64(0)
-		prevFiles = []string{filename}
+	}
 
+	// Make sure that manifest updates that have failed are retried without waiting for events
+	pendingManifests, _ = readPendingManifests(archiveID)
+	if len(pendingManifests) > 0 {
+		nextDue = earliestTime(nextDue, time.Now().Add(manifestRetryDelay))
 	}
 
+	return nextDue
+
 }
 
-// Upload an archive
-func uploadArchive(rc RouteConfig, bucketKey string, filepaths []string) (err error) {
-
-	// Generate the archive object in-memory
-	useArray := false
-	outArray := []interface{}{}
-	useMap := false
-	outMap := map[string][]interface{}{}
-	outBytes := []byte{}
-	for _, filepath := range filepaths {
-		eventJSON, err := os.ReadFile(filepath)
-		if err != nil {
-			fmt.Printf("error reading %s: %s\n", filepath, err)
-			continue
+// Return the earlier of two times, where zero means never
+func earliestTime(a time.Time, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// Key of the object to which a staged archive is uploaded, which is named for the times of
+// the first and last events encoded in it and for their count.  When the route's time_basis
+// has a resolution of only a second, the times of events in different batches may be the
+// same, so the key is followed by the ID of the batch.
+func archiveKey(rc RouteConfig, batch archiveBatch, info stagedInfo) string {
+	folder := strings.ReplaceAll(batch.Folder, " ", "/")
+	if rc.TimeBasis == timeBasisWhen || rc.TimeBasis == timeBasisRouted {
+		return fmt.Sprintf("%s/%d-%d-%d-%s%s", folder, info.First, info.Last, info.Events, batch.id(), archiveFileSuffix(rc))
+	}
+	return fmt.Sprintf("%s/%d-%d-%d%s", folder, info.First, info.Last, info.Events, archiveFileSuffix(rc))
+}
+
+// Upload a batch as an archive.  The archive is first encoded into a staging file on local
+// disk so that memory usage is bounded regardless of the number of events in the archive,
+// and so that an interrupted upload of a large archive may later be resumed rather than
+// restarted.
+func uploadArchive(rc RouteConfig, batch archiveBatch) (err error) {
+
+	// Bound the time spent talking to the sink, so that a hung endpoint fails the upload
+	// rather than tying up a worker indefinitely
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(rc.UploadTimeoutMins)*time.Minute)
+	defer cancel()
+
+	sink, err := newSink(ctx, rc)
+	if err != nil {
+		return err
+	}
+
+	// Stage the archive, unless it was staged by a previous attempt that failed to upload
+	stagedName := batch.stagedName()
+	stagedPath := configDataPath(rc.ArchiveID+instanceUploads) + stagedName
+	_, err = os.Stat(stagedPath)
+	var info stagedInfo
+	if err == nil {
+		info, err = readStagedInfo(stagedPath)
+	}
+	if err != nil {
+		err = stageArchive(rc, stagedPath, batch.Segments)
+		if err == nil {
+			info, err = readStagedInfo(stagedPath)
 		}
-		var event map[string]interface{}
-		err = note.JSONUnmarshal(eventJSON, &event)
 		if err != nil {
-			fmt.Printf("error unmarshaling %s: %s\n", filepath, err)
-			continue
+			return err
 		}
+	}
 
-		// Generate the structure based upon array format
-		if rc.FileFormat == "array" {
-			useArray = true
-			outArray = append(outArray, event)
-		} else if strings.HasPrefix(rc.FileFormat, "object:") {
-			useMap = true
-			fieldName := strings.TrimPrefix(rc.FileFormat, "object:")
-			outMap[fieldName] = append(outMap[fieldName], event)
-		} else if rc.FileFormat == "ndjson" {
-			outBytes = append(outBytes, eventJSON...)
-			outBytes = append(outBytes, []byte("\n")...)
-		} else {
-			return fmt.Errorf("invalid file format: %s", rc.FileFormat)
-		}
+	// If none of the events could be encoded, they have all been skipped or moved to the
+	// dead letter directory, and there is nothing to upload
+	if info.Events == 0 {
+		os.Remove(stagedPath)
+		os.Remove(stagedPath + stagedInfoSuffix)
+		fmt.Printf("archive: %s folder '%s' has no events that could be archived\n", rc.ArchiveID, batch.Folder)
+		return nil
+	}
 
+	// Discard the remnants of uploads of this folder that will never be resumed, because
+	// events have since been added to the folder and so it is a different batch
+	bucketKey := archiveKey(rc, batch, info)
+	purgeStagedArchives(ctx, rc, sink, stagedName, bucketKey)
+
+	// Write the archive to the route's sink, decrypting it as it is read if it was
+	// encrypted at rest
+	file, err := os.Open(stagedPath)
+	if err != nil {
+		return fmt.Errorf("can't open staged archive: %s", err)
+	}
+	opts := SinkPutOptions{}
+	opts.ContentType, opts.ContentEncoding = archiveContentType(rc)
+	opts.ACL = s3ObjectACL(rc)
+	opts.StorageClass = rc.FileStorageClass
+	opts.Metadata = info.metadata()
+	opts.SHA256 = info.SHA256
+	reader, size, err := atRestStageReader(rc.ArchiveID, file)
+	if err == nil {
+		err = sink.PutObject(ctx, bucketKey, reader, size, opts)
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+	os.Remove(stagedPath)
+	os.Remove(stagedPath + stagedInfoSuffix)
+
+	// List the archive in its folder's manifest.  The archive has been uploaded, so failing
+	// here must not fail the batch, which would cause its events to be uploaded again;
+	// instead, the archive is listed on the archive's next pass.
+	object := manifestObject{Key: bucketKey, Size: size, SHA256: info.SHA256, Events: info.Events, First: info.First,
+		Last: info.Last, EventUIDsSHA256: info.EventUIDsSHA256, Archived: time.Now().Unix()}
+	manifestErr := updateManifests(ctx, rc, sink, []manifestObject{object})
+	if manifestErr != nil {
+		fmt.Printf("archive: %s: %s\n", rc.ArchiveID, manifestErr)
 	}
 
-	// Unpack into bytes if appropriate
-	if useArray {
-		outBytes, err = note.JSONMarshal(outArray)
-		if err != nil {
-			return fmt.Errorf("can't marshal array: %s", err)
+	// Record the archive in the local catalog, which is likewise not allowed to fail the batch
+	entry := catalogEntry{ArchiveID: rc.ArchiveID, Key: bucketKey, Devices: info.Devices, First: object.First, Last: object.Last,
+		Events: info.Events, Size: size, SHA256: info.SHA256, Uploaded: object.Archived}
+	catalogErr := catalogAdd(entry)
+	if catalogErr != nil {
+		fmt.Printf("archive: %s: %s\n", rc.ArchiveID, catalogErr)
+	}
+
+	// Write the DDL of the route's table, if it has one, so that it reflects the route's
+	// current configuration
+	if rc.FileTable != "" {
+		tableErr := updateTableDDL(ctx, rc, sink)
+		if tableErr != nil {
+			fmt.Printf("archive: %s: %s\n", rc.ArchiveID, tableErr)
 		}
-	} else if useMap {
-		outBytes, err = note.JSONMarshal(outMap)
+	}
+
+	// Done
+	return
+
+}
+
+// Encode the events into a staging file, atomically renaming it into place when complete
+func stageArchive(rc RouteConfig, stagedPath string, segments []spoolSegment) (err error) {
+
+	tempPath := path.Join(path.Dir(stagedPath), uuid.New().String()+".temp")
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("can't create staged archive: %s", err)
+	}
+
+	// The archive is encoded, then compressed, then encrypted for the bucket if the route
+	// has a public key, and then encrypted at rest if enabled.  The checksum is of the
+	// object as it will be uploaded, so it is computed before encryption at rest.
+	writer := bufio.NewWriter(file)
+	objectHash := sha256.New()
+	var atRestEncrypter, encrypter, compressor io.WriteCloser
+	var encoder archiveEncoder
+	atRestEncrypter, err = atRestStageWriter(rc.ArchiveID, writer)
+	if err == nil {
+		encrypter, err = newArchiveEncrypter(rc.FilePublicKey, io.MultiWriter(atRestEncrypter, objectHash))
+	}
+	if err == nil {
+		compressor, err = newArchiveCompressor(archiveStreamCompression(rc), encrypter)
+	}
+	if err == nil {
+		encoder, err = newArchiveEncoder(rc, compressor)
+	}
+	var encoded encodeResult
+	if err == nil {
+		encoded, err = encodeArchive(encoder, rc.ArchiveID, segments)
+	}
+	if err == nil {
+		err = compressor.Close()
+	}
+	if err == nil {
+		err = encrypter.Close()
+	}
+	if err == nil {
+		err = atRestEncrypter.Close()
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		info := stagedInfo{}
+		info.SHA256 = hex.EncodeToString(objectHash.Sum(nil))
+		info.Events = len(encoded.EventUIDs)
+		info.First = encoded.First
+		info.Last = encoded.Last
+		info.EventUIDsSHA256 = hashEventUIDs(encoded.EventUIDs)
+		info.Devices = encoded.Devices
+		err = writeStagedInfo(stagedPath, info)
+	}
+	if err == nil {
+		err = os.Rename(tempPath, stagedPath)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	// Move events that couldn't be parsed to the dead letter directory, rather than
+	// dropping them.  Because the entry is named for the batch, restaging the same batch
+	// replaces the entry rather than duplicating it.
+	if len(encoded.Poison) > 0 {
+		err = deadLetterPoison(rc.ArchiveID, segments[0].Folder, path.Base(stagedPath), encoded.Poison, encoded.PoisonReasons)
 		if err != nil {
-			return fmt.Errorf("can't marshal map: %s", err)
+			fmt.Printf("archive: %s: %s\n", rc.ArchiveID, err)
 		}
 	}
 
-	// Upload bytes to S3
-	bucket := aws.String(rc.BucketName)
-	key := aws.String(bucketKey)
-	s3Config := &aws.Config{
-		Credentials:      credentials.NewStaticCredentials(rc.KeyID, rc.KeySecret, ""),
-		Endpoint:         aws.String(rc.BucketEndpoint),
-		Region:           aws.String(rc.BucketRegion),
-		S3ForcePathStyle: aws.Bool(true),
+	return nil
+
+}
+
+// Discard the staged archive, and any interrupted upload, of a batch that is being abandoned
+func abandonUpload(rc RouteConfig, batch archiveBatch) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(rc.UploadTimeoutMins)*time.Minute)
+	defer cancel()
+	stagedPath := configDataPath(rc.ArchiveID+instanceUploads) + batch.stagedName()
+	info, err := readStagedInfo(stagedPath)
+	if err == nil && info.Events > 0 {
+		sink, err := newSink(ctx, rc)
+		if err == nil {
+			sink.AbortObject(ctx, archiveKey(rc, batch, info))
+		}
 	}
-	newSession, err := session.NewSession(s3Config)
+	os.Remove(stagedPath)
+	os.Remove(stagedPath + stagedInfoSuffix)
+}
+
+// Remove staging files and interrupted uploads for the same folder as the archive about to
+// be uploaded, other than its own, along with temp files left behind by an interrupted staging
+func purgeStagedArchives(ctx context.Context, rc RouteConfig, sink Sink, stagedName string, bucketKey string) {
+
+	folder := stagedName[:strings.LastIndex(stagedName, " ")]
+	uploadName := strings.ReplaceAll(bucketKey, "/", " ")
+	uploadsPath := configDataPath(rc.ArchiveID + instanceUploads)
+	uploadsDir, err := os.Open(uploadsPath)
 	if err != nil {
-		return fmt.Errorf("error creating session: %s", err)
+		return
 	}
-	s3Client := s3.New(newSession)
-	cparams := &s3.CreateBucketInput{
-		Bucket: bucket,
+	files, _ := uploadsDir.ReadDir(0)
+	uploadsDir.Close()
+	for _, file := range files {
+		filename := file.Name()
+		if strings.HasSuffix(filename, ".temp") {
+			os.Remove(uploadsPath + filename)
+			continue
+		}
+		isUpload := strings.HasSuffix(filename, multipartStateSuffix)
+		filename = strings.TrimSuffix(filename, multipartStateSuffix)
+		filename = strings.TrimSuffix(filename, stagedInfoSuffix)
+		index := strings.LastIndex(filename, " ")
+		if index == -1 || filename[:index] != folder || filename == stagedName || filename == uploadName {
+			continue
+		}
+		if isUpload {
+			sink.AbortObject(ctx, strings.ReplaceAll(filename, " ", "/"))
+			continue
+		}
+		os.Remove(uploadsPath + filename)
+		os.Remove(uploadsPath + filename + stagedInfoSuffix)
 	}
-	s3Client.CreateBucket(cparams)
-	puparams := &s3.PutObjectInput{
-		Body:   strings.NewReader(string(outBytes)),
-		Bucket: bucket,
-		Key:    key,
+
+}
+
+// Result of encoding an archive, being the UIDs of the events that were encoded, the times of
+// the first and last of them, and the devices that sent them, and the records of those that
+// are malformed along with the reason that each couldn't be encoded
+type encodeResult struct {
+	EventUIDs     []string
+	First         int64
+	Last          int64
+	Devices       []string
+	Poison        []spoolRecord
+	PoisonReasons []string
+}
+
+// Encode the events in the specified segments
+func encodeArchive(encoder archiveEncoder, archiveID string, segments []spoolSegment) (result encodeResult, err error) {
+
+	incomingPath := configDataPath(archiveID + instanceIncomingEvents)
+
+	// Encoders whose schema depends upon the events must first be shown all of them
+	schemaEncoder, isSchemaEncoder := encoder.(archiveSchemaEncoder)
+	if isSchemaEncoder && schemaEncoder.InfersSchema() {
+		for _, segment := range segments {
+			err = spoolReadSegment(incomingPath+segment.Name, func(record spoolRecord) error {
+				var event map[string]interface{}
+				eventJSON, err := atRestOpen(archiveID, record.EventJSON)
+				if err == nil {
+					err = note.JSONUnmarshal(eventJSON, &event)
+				}
+				if err == nil {
+					schemaEncoder.InferEvent(event)
+				}
+				return nil
+			})
+			if err != nil {
+				return result, fmt.Errorf("error reading %s: %s", segment.Name, err)
+			}
+		}
 	}
-	_, err = s3Client.PutObject(puparams)
-	if err != nil {
-		return fmt.Errorf("err uploading object: %s", err)
+
+	devices := map[string]bool{}
+	for _, segment := range segments {
+		err = spoolReadSegment(incomingPath+segment.Name, func(record spoolRecord) error {
+			var event map[string]interface{}
+			eventJSON, err := atRestOpen(archiveID, record.EventJSON)
+			if err == nil {
+				err = note.JSONUnmarshal(eventJSON, &event)
+			}
+			if err != nil {
+				fmt.Printf("error unmarshaling event in %s: %s\n", segment.Name, err)
+				result.Poison = append(result.Poison, record)
+				result.PoisonReasons = append(result.PoisonReasons, fmt.Sprintf("event received at %d: %s", record.ReceivedUs, err))
+				return nil
+			}
+			err = encoder.WriteEvent(event, eventJSON)
+			if rejected, isRejected := err.(eventRejectedError); isRejected {
+				if rejected.DeadLetter {
+					result.Poison = append(result.Poison, record)
+					result.PoisonReasons = append(result.PoisonReasons, fmt.Sprintf("event received at %d: %s", record.ReceivedUs, rejected.Reason))
+				}
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if len(result.EventUIDs) == 0 || record.ReceivedUs < result.First {
+				result.First = record.ReceivedUs
+			}
+			if record.ReceivedUs > result.Last {
+				result.Last = record.ReceivedUs
+			}
+			uid, _ := event["event"].(string)
+			result.EventUIDs = append(result.EventUIDs, uid)
+			device, _ := event["device"].(string)
+			if device != "" && !devices[device] {
+				devices[device] = true
+				result.Devices = append(result.Devices, device)
+			}
+			return nil
+		})
+		if err != nil {
+			return result, fmt.Errorf("error reading %s: %s", segment.Name, err)
+		}
 	}
 
-	// Done
-	return
+	sort.Strings(result.Devices)
+	return result, encoder.Close()
 
 }
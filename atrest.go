@@ -0,0 +1,435 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Envelope encryption of data at rest.  When a master key file is configured, each archive
+// has a keyring of data keys, stored in its data directory wrapped by the master key.  Spooled
+// events, staged archives, and the credentials in route.json are encrypted with the archive's
+// current data key.  Rotation generates a new master key and a new data key for each archive,
+// retaining earlier data keys so that data encrypted with them remains readable until archived.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/blues/note-go/note"
+	"github.com/google/uuid"
+)
+
+// Environment variable specifying the path of the master key file.  If it is not set, data
+// is stored in cleartext.
+const atRestMasterKeyEnv = "ARCHIVE_MASTER_KEY"
+
+// Suffix of the new master key file written while a rotation is in progress
+const atRestPendingSuffix = ".new"
+
+// Name of each archive's keyring within its data directory
+const atRestKeyringFile = "keys.json"
+
+// Encrypted spool records and staged archives begin with this byte, which can't begin
+// an event, a compressed stream, or an archive, followed by the length and ID of the data key
+const atRestMarker = 0
+
+// Encrypted route config fields are formatted as "sealed:<keyID>:<base64>"
+const atRestSealedPrefix = "sealed:"
+
+// A data key, wrapped by the master key with the specified fingerprint
+type atRestWrappedKey struct {
+	Master  string `json:"master"`
+	Wrapped string `json:"wrapped"`
+}
+
+// An archive's data keys, and the ID of the one currently used to encrypt
+type atRestKeyring struct {
+	Current string                      `json:"current"`
+	Keys    map[string]atRestWrappedKey `json:"keys"`
+	keys    map[string][]byte
+}
+
+// Encryption state, all protected by the lock
+var atRestLock sync.Mutex
+var atRestMasterPath string
+var atRestMasters = map[string][]byte{}
+var atRestMaster string
+var atRestKeyrings = map[string]*atRestKeyring{}
+
+// Load the master key if one is configured, generating it if the file doesn't yet exist.  If
+// a rotation was interrupted, the new master key becomes current so that it may be completed.
+func atRestInit() (err error) {
+	atRestLock.Lock()
+	defer atRestLock.Unlock()
+
+	atRestMasterPath = os.Getenv(atRestMasterKeyEnv)
+	if atRestMasterPath == "" {
+		return nil
+	}
+	key, err := atRestReadMasterKey(atRestMasterPath, true)
+	if err != nil {
+		return err
+	}
+	atRestMaster = atRestFingerprint(key)
+	atRestMasters[atRestMaster] = key
+
+	pendingPath := atRestMasterPath + atRestPendingSuffix
+	_, err = os.Stat(pendingPath)
+	if err == nil {
+		key, err = atRestReadMasterKey(pendingPath, false)
+		if err != nil {
+			return err
+		}
+		atRestMaster = atRestFingerprint(key)
+		atRestMasters[atRestMaster] = key
+		fmt.Printf("encryption: key rotation was interrupted, use the rotatekeys command to complete it\n")
+	}
+
+	fmt.Printf("encryption: data at rest is encrypted using master key %s\n", atRestMaster)
+	return nil
+}
+
+// Determine whether or not data is encrypted at rest
+func atRestEnabled() bool {
+	atRestLock.Lock()
+	defer atRestLock.Unlock()
+	return atRestMaster != ""
+}
+
+// Read a master key file containing either 32 bytes or 64 hex digits, optionally generating
+// a new key if the file doesn't exist
+func atRestReadMasterKey(keyPath string, generate bool) (key []byte, err error) {
+	contents, err := os.ReadFile(keyPath)
+	if err != nil && os.IsNotExist(err) && generate {
+		key, err = cryptNewKey()
+		if err == nil {
+			err = os.WriteFile(keyPath, []byte(hex.EncodeToString(key)+"\n"), 0600)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't create master key %s: %s", keyPath, err)
+		}
+		fmt.Printf("encryption: created master key %s\n", keyPath)
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read master key: %s", err)
+	}
+	if len(contents) == 32 {
+		return contents, nil
+	}
+	key, err = hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("master key %s must contain 32 bytes or 64 hex digits", keyPath)
+	}
+	return key, nil
+}
+
+// Identify a master key without revealing it
+func atRestFingerprint(key []byte) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:8])
+}
+
+// Load an archive's keyring, creating it if it doesn't exist, which must be called with the
+// lock held
+func atRestLoadKeyring(archiveID string) (keyring *atRestKeyring, err error) {
+	keyring, present := atRestKeyrings[archiveID]
+	if present {
+		return keyring, nil
+	}
+
+	keyring = &atRestKeyring{}
+	keyringJSON, err := os.ReadFile(configDataPath(archiveID) + atRestKeyringFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = note.JSONUnmarshal(keyringJSON, keyring)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse keyring: %s", err)
+		}
+	}
+	keyring.keys = map[string][]byte{}
+	for keyID, wrappedKey := range keyring.Keys {
+		masterKey, present := atRestMasters[wrappedKey.Master]
+		if !present {
+			return nil, fmt.Errorf("data key %s is wrapped by unknown master key %s", keyID, wrappedKey.Master)
+		}
+		wrapped, err := base64.StdEncoding.DecodeString(wrappedKey.Wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("data key %s is malformed", keyID)
+		}
+		keyring.keys[keyID], err = cryptOpen(masterKey, wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("data key %s: %s", keyID, err)
+		}
+	}
+	if keyring.Current == "" {
+		err = atRestAddKey(archiveID, keyring)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	atRestKeyrings[archiveID] = keyring
+	return keyring, nil
+}
+
+// Add a new data key to a keyring, making it current, and save the keyring wrapped by the
+// current master key.  This must be called with the lock held.
+func atRestAddKey(archiveID string, keyring *atRestKeyring) (err error) {
+	key, err := cryptNewKey()
+	if err != nil {
+		return err
+	}
+	keyID := uuid.New().String()[:8]
+	keyring.keys[keyID] = key
+	keyring.Current = keyID
+
+	masterKey := atRestMasters[atRestMaster]
+	keyring.Keys = map[string]atRestWrappedKey{}
+	for keyID, key := range keyring.keys {
+		wrapped, err := cryptSeal(masterKey, key)
+		if err != nil {
+			return err
+		}
+		keyring.Keys[keyID] = atRestWrappedKey{Master: atRestMaster, Wrapped: base64.StdEncoding.EncodeToString(wrapped)}
+	}
+	keyringJSON, err := note.JSONMarshal(keyring)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(configDataPath(archiveID)+atRestKeyringFile, keyringJSON)
+}
+
+// Get the ID and value of the data key with which to encrypt an archive's data
+func atRestCurrentKey(archiveID string) (keyID string, key []byte, err error) {
+	atRestLock.Lock()
+	defer atRestLock.Unlock()
+	keyring, err := atRestLoadKeyring(archiveID)
+	if err != nil {
+		return "", nil, err
+	}
+	return keyring.Current, keyring.keys[keyring.Current], nil
+}
+
+// Get a data key of an archive by its ID
+func atRestKey(archiveID string, keyID string) (key []byte, err error) {
+	atRestLock.Lock()
+	defer atRestLock.Unlock()
+	keyring, err := atRestLoadKeyring(archiveID)
+	if err != nil {
+		return nil, err
+	}
+	key, present := keyring.keys[keyID]
+	if !present {
+		return nil, fmt.Errorf("data key %s not found in keyring of %s", keyID, archiveID)
+	}
+	return key, nil
+}
+
+// Format the header of encrypted data
+func atRestHeader(keyID string) []byte {
+	return append([]byte{atRestMarker, byte(len(keyID))}, keyID...)
+}
+
+// Parse the header of encrypted data, returning the ID of its data key and the header's length
+func atRestParseHeader(data []byte) (keyID string, length int, err error) {
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return "", 0, fmt.Errorf("encrypted data is too short")
+	}
+	return string(data[2 : 2+int(data[1])]), 2 + int(data[1]), nil
+}
+
+// Encrypt a spooled event, if encryption is enabled
+func atRestSeal(archiveID string, plaintext []byte) (data []byte, err error) {
+	if !atRestEnabled() {
+		return plaintext, nil
+	}
+	keyID, key, err := atRestCurrentKey(archiveID)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := cryptSeal(key, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return append(atRestHeader(keyID), sealed...), nil
+}
+
+// Decrypt a spooled event, which may have been spooled in cleartext
+func atRestOpen(archiveID string, data []byte) (plaintext []byte, err error) {
+	if len(data) == 0 || data[0] != atRestMarker {
+		return data, nil
+	}
+	keyID, length, err := atRestParseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	key, err := atRestKey(archiveID, keyID)
+	if err != nil {
+		return nil, err
+	}
+	return cryptOpen(key, data[length:])
+}
+
+// Encrypt a route config field, if encryption is enabled
+func atRestSealString(archiveID string, value string) (sealedValue string, err error) {
+	if value == "" || !atRestEnabled() {
+		return value, nil
+	}
+	keyID, key, err := atRestCurrentKey(archiveID)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := cryptSeal(key, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	return atRestSealedPrefix + keyID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt a route config field, which may have been stored in cleartext
+func atRestOpenString(archiveID string, value string) (plaintext string, err error) {
+	if !strings.HasPrefix(value, atRestSealedPrefix) {
+		return value, nil
+	}
+	fields := strings.SplitN(strings.TrimPrefix(value, atRestSealedPrefix), ":", 2)
+	if len(fields) != 2 {
+		return "", fmt.Errorf("encrypted field is malformed")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", fmt.Errorf("encrypted field is malformed")
+	}
+	key, err := atRestKey(archiveID, fields[0])
+	if err != nil {
+		return "", err
+	}
+	plaintextBytes, err := cryptOpen(key, sealed)
+	return string(plaintextBytes), err
+}
+
+// Create a writer that encrypts a staged archive, if encryption is enabled.  Closing the
+// writer writes the end of the encrypted stream without closing the underlying writer.
+func atRestStageWriter(archiveID string, w io.Writer) (writer io.WriteCloser, err error) {
+	if !atRestEnabled() {
+		return nopWriteCloser{w}, nil
+	}
+	keyID, key, err := atRestCurrentKey(archiveID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(atRestHeader(keyID))
+	if err != nil {
+		return nil, err
+	}
+	return newCryptStreamWriter(w, key)
+}
+
+// Open a staged archive for reading at random offsets, decrypting it if it was encrypted,
+// and returning its decrypted size
+func atRestStageReader(archiveID string, file *os.File) (reader io.ReaderAt, size int64, err error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	header := make([]byte, 2+255)
+	n, _ := file.ReadAt(header, 0)
+	if n == 0 || header[0] != atRestMarker {
+		return file, info.Size(), nil
+	}
+	keyID, length, err := atRestParseHeader(header[:n])
+	if err != nil {
+		return nil, 0, err
+	}
+	key, err := atRestKey(archiveID, keyID)
+	if err != nil {
+		return nil, 0, err
+	}
+	streamReader, err := newCryptStreamReader(io.NewSectionReader(file, int64(length), info.Size()-int64(length)), info.Size()-int64(length), key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return streamReader, streamReader.Size(), nil
+}
+
+// Rotate keys, generating a new master key and giving each archive a new data key.  Every
+// keyring is rewrapped by the new master key before it replaces the old one, so an
+// interrupted rotation is completed by performing it again.  Superseded data keys are never
+// removed from a keyring, because events that were spooled, staged, or dead-lettered under
+// them may remain on disk for as long as their archive fails to upload.
+func atRestRotate() (err error) {
+	atRestLock.Lock()
+	if atRestMaster == "" {
+		atRestLock.Unlock()
+		return fmt.Errorf("encryption at rest is not enabled because %s is not set", atRestMasterKeyEnv)
+	}
+	pendingPath := atRestMasterPath + atRestPendingSuffix
+	key, err := atRestReadMasterKey(pendingPath, true)
+	if err != nil {
+		atRestLock.Unlock()
+		return err
+	}
+	atRestMaster = atRestFingerprint(key)
+	atRestMasters[atRestMaster] = key
+	atRestLock.Unlock()
+
+	// Give each archive a new data key, and re-encrypt its route config or, if it is defined in
+	// the store, its overrides with it
+	dataDir, err := os.Open(configDataPath(""))
+	if err != nil {
+		return err
+	}
+	archiveIDFiles, err := dataDir.ReadDir(0)
+	dataDir.Close()
+	if err != nil {
+		return err
+	}
+	for _, archiveIDFile := range archiveIDFiles {
+		if !archiveIDFile.IsDir() {
+			continue
+		}
+		archiveID := archiveIDFile.Name()
+		atRestLock.Lock()
+		var keyring *atRestKeyring
+		keyring, err = atRestLoadKeyring(archiveID)
+		if err == nil {
+			err = atRestAddKey(archiveID, keyring)
+		}
+		atRestLock.Unlock()
+		if err != nil {
+			return fmt.Errorf("%s: %s", archiveID, err)
+		}
+		rc, err := readRouteConfig(archiveID)
+		if err == nil {
+			err = writeRouteConfig(rc)
+			if err != nil {
+				return fmt.Errorf("%s: %s", archiveID, err)
+			}
+		}
+		overrides, err := readStoredOverrides(archiveID)
+		if err == nil && len(overrides) > 0 {
+			err = writeStoredOverrides(archiveID, overrides)
+			if err != nil {
+				return fmt.Errorf("%s: %s", archiveID, err)
+			}
+		}
+	}
+
+	// Replace the old master key, which no longer wraps any data key
+	err = os.Rename(pendingPath, atRestMasterPath)
+	if err != nil {
+		return err
+	}
+	atRestLock.Lock()
+	atRestMasters = map[string][]byte{atRestMaster: key}
+	atRestLock.Unlock()
+	fmt.Printf("encryption: rotated to master key %s\n", atRestMaster)
+
+	return nil
+}
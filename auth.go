@@ -0,0 +1,66 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Optional per-archive authentication of inbound events.  The first request for an archive
+// that supplies a secret pins that secret in the archive's route config, after which every
+// request must either present the same secret, or sign the event with it.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Request header fields used for authentication
+const authSecretHeader = "archive_secret"
+const authSignatureHeader = "archive_signature"
+const authBearerPrefix = "Bearer "
+
+// Get the secret presented by a request, either in the archive_secret header or as a
+// bearer token in the Authorization header
+func requestSecret(r *http.Request) (secret string) {
+	secret, exists := headerField(r, authSecretHeader)
+	if exists {
+		return secret
+	}
+	authorization := r.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, authBearerPrefix) {
+		return strings.TrimSpace(strings.TrimPrefix(authorization, authBearerPrefix))
+	}
+	return ""
+}
+
+// Determine whether or not a request is authorized by the pinned secret, either because
+// it presents the secret or because it carries a hex HMAC-SHA256 signature of the body
+// computed using the secret.  Comparisons are made in constant time.
+func requestAuthorized(r *http.Request, body []byte, pinnedSecret string) bool {
+	if pinnedSecret == "" {
+		return true
+	}
+	if requestSecret(r) != "" {
+		return requestPresentsSecret(r, pinnedSecret)
+	}
+	signature, exists := headerField(r, authSignatureHeader)
+	if !exists {
+		return false
+	}
+	signatureBytes, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(pinnedSecret))
+	mac.Write(body)
+	return hmac.Equal(signatureBytes, mac.Sum(nil))
+}
+
+// Determine whether or not a request presents the pinned secret itself, rather than a
+// signature, which is required of requests without a body whose signature would never vary
+func requestPresentsSecret(r *http.Request, pinnedSecret string) bool {
+	secret := requestSecret(r)
+	return secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(pinnedSecret)) == 1
+}
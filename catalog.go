@@ -0,0 +1,187 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Local catalog of every archive that has been uploaded, so that the server retains a record
+// of what it archived after the spooled events have been removed.  The catalog is a bbolt
+// database with a bucket for each archive ID, in which each uploaded object is keyed by its
+// key within the sink.  It may be queried using the catalog console command or the /catalog
+// HTTP endpoint.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/blues/note-go/note"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Environment variable that may be used to override the location of the catalog
+const catalogEnv = "ARCHIVE_CATALOG"
+
+// Default location of the catalog, relative to the home directory
+const catalogFile = "/catalog.db"
+
+// The open catalog, which is nil if the catalog isn't in use
+var catalogDB *bolt.DB
+
+// An uploaded archive, where First and Last are the times in microseconds of its first and
+// last events according to the route's time_basis, and Uploaded is the time of the upload in
+// seconds
+type catalogEntry struct {
+	ArchiveID string   `json:"archive_id"`
+	Key       string   `json:"key"`
+	Devices   []string `json:"devices,omitempty"`
+	First     int64    `json:"first"`
+	Last      int64    `json:"last"`
+	Events    int      `json:"events"`
+	Size      int64    `json:"size"`
+	SHA256    string   `json:"sha256"`
+	Uploaded  int64    `json:"uploaded"`
+}
+
+// Criteria for selecting catalog entries, any of which may be left empty.  An entry is
+// selected if the times of any of its events are between Since and Until.
+type catalogQuery struct {
+	ArchiveID string
+	Prefix    string
+	Device    string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+// Get the path of the catalog
+func catalogPath() string {
+	path := os.Getenv(catalogEnv)
+	if path == "" {
+		homedir, _ := os.UserHomeDir()
+		path = homedir + catalogFile
+	}
+	return path
+}
+
+// Open the catalog, creating it if it doesn't exist
+func catalogInit() (err error) {
+	db, err := bolt.Open(catalogPath(), 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("can't open %s: %s", catalogPath(), err)
+	}
+	catalogDB = db
+	return nil
+}
+
+// Record an uploaded archive, replacing any previous record of the same key
+func catalogAdd(entry catalogEntry) (err error) {
+	if catalogDB == nil {
+		return nil
+	}
+	entryJSON, err := note.JSONMarshal(entry)
+	if err != nil {
+		return err
+	}
+	err = catalogDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(entry.ArchiveID))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(entry.Key), entryJSON)
+	})
+	if err != nil {
+		return fmt.Errorf("can't add %s to catalog: %s", entry.Key, err)
+	}
+	return nil
+}
+
+// Determine whether or not an entry matches a query
+func (query catalogQuery) matches(entry catalogEntry) bool {
+	if !query.Since.IsZero() && entry.Last < query.Since.UnixMicro() {
+		return false
+	}
+	if !query.Until.IsZero() && entry.First > query.Until.UnixMicro() {
+		return false
+	}
+	if query.Device == "" {
+		return true
+	}
+	for _, device := range entry.Devices {
+		if device == query.Device {
+			return true
+		}
+	}
+	return false
+}
+
+// Find the entries matching a query, in order of archive ID and then key
+func catalogFind(query catalogQuery) (entries []catalogEntry, err error) {
+	if catalogDB == nil {
+		return nil, fmt.Errorf("catalog is not open")
+	}
+	err = catalogDB.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(archiveID []byte, bucket *bolt.Bucket) error {
+			if query.ArchiveID != "" && string(archiveID) != query.ArchiveID {
+				return nil
+			}
+			cursor := bucket.Cursor()
+			prefix := []byte(query.Prefix)
+			for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+				if query.Limit > 0 && len(entries) >= query.Limit {
+					return nil
+				}
+				var entry catalogEntry
+				err := note.JSONUnmarshal(value, &entry)
+				if err != nil {
+					return fmt.Errorf("can't parse entry %s: %s", key, err)
+				}
+				if query.matches(entry) {
+					entries = append(entries, entry)
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't read catalog: %s", err)
+	}
+	return entries, nil
+}
+
+// Print a summary of the catalog of every archive, or the entries of one archive
+func catalogList(archiveID string, device string) {
+	entries, err := catalogFind(catalogQuery{ArchiveID: archiveID, Device: device})
+	if err != nil {
+		fmt.Printf("catalog: %s\n", err)
+		return
+	}
+	if len(entries) == 0 {
+		fmt.Printf("catalog is empty\n")
+		return
+	}
+
+	// List the individual entries of a single archive
+	if archiveID != "" {
+		for _, entry := range entries {
+			fmt.Printf("%s %d events %d bytes %s to %s uploaded %s devices %s sha256 %s\n", entry.Key, entry.Events, entry.Size,
+				time.UnixMicro(entry.First).UTC().Format(time.RFC3339), time.UnixMicro(entry.Last).UTC().Format(time.RFC3339),
+				time.Unix(entry.Uploaded, 0).UTC().Format(time.RFC3339), strings.Join(entry.Devices, ","), entry.SHA256)
+		}
+		return
+	}
+
+	// Summarize each archive
+	objects, events, size := 0, 0, int64(0)
+	for i, entry := range entries {
+		objects++
+		events += entry.Events
+		size += entry.Size
+		if i == len(entries)-1 || entries[i+1].ArchiveID != entry.ArchiveID {
+			fmt.Printf("%s: %d objects, %d events, %d bytes\n", entry.ArchiveID, objects, events, size)
+			objects, events, size = 0, 0, 0
+		}
+	}
+
+}
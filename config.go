@@ -6,7 +6,11 @@ package main
 
 import (
 	"os"
+	"path"
+	"strconv"
 	"strings"
+
+	"github.com/google/uuid"
 )
 
 // ConfigPath (here for golint)
@@ -25,3 +29,51 @@ func configDataPath(folder string) string {
 	}
 	return path
 }
+
+// Environment variable that may be used to override where file sinks are rooted,
+// such as to place archives onto an NFS mount
+const sinkPathEnv = "ARCHIVE_SINK_PATH"
+
+// Default location of file sinks, relative to the home directory
+const sinkPath = "/sink/"
+
+// Environment variable that must be set to "true" for routes to select the file sink through
+// their headers, because it writes to the server's own disk.  Archives defined in the config
+// store may always use it.
+const fileSinkEnv = "ARCHIVE_FILE_SINK"
+
+// Determine whether or not routes may select the file sink through their headers
+func configFileSinkEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv(fileSinkEnv))
+	return enabled
+}
+
+// Retrieve the directory that a file sink for the specified bucket is rooted in
+func configSinkPath(bucket string) string {
+	path := os.Getenv(sinkPathEnv)
+	if path == "" {
+		homedir, _ := os.UserHomeDir()
+		path = homedir + sinkPath
+	}
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	path += bucket + "/"
+	os.MkdirAll(path, 0777)
+	return path
+}
+
+// Write a file in the data directory in an atomic way, by writing to a temp file
+// and then renaming it over the target
+func writeFileAtomic(filePath string, data []byte) (err error) {
+	tempPath := path.Join(path.Dir(filePath), uuid.New().String()+".temp")
+	err = os.WriteFile(tempPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempPath, filePath)
+	if err != nil {
+		os.Remove(tempPath)
+	}
+	return err
+}
@@ -0,0 +1,219 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// AES-GCM encryption primitives.  Small values are sealed in a single operation, while
+// large files are encrypted as a stream of independently-authenticated chunks so that they
+// may be written incrementally, and read at random offsets, without being held in memory.
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Size of the plaintext within each chunk of an encrypted stream
+const cryptChunkSize = 64 * 1024
+
+// Size of the random nonce prefix written at the start of an encrypted stream
+const cryptStreamNonceSize = 7
+
+// Create an AES-GCM cipher from a 256-bit key
+func cryptNewGCM(key []byte) (aead cipher.AEAD, err error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Generate a random 256-bit key
+func cryptNewKey() (key []byte, err error) {
+	key = make([]byte, 32)
+	_, err = rand.Read(key)
+	return key, err
+}
+
+// Seal a value, returning the nonce followed by the ciphertext
+func cryptSeal(key []byte, plaintext []byte) (sealed []byte, err error) {
+	aead, err := cryptNewGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Open a value sealed with cryptSeal
+func cryptOpen(key []byte, sealed []byte) (plaintext []byte, err error) {
+	aead, err := cryptNewGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted value is too short")
+	}
+	plaintext, err = aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt: %s", err)
+	}
+	return plaintext, nil
+}
+
+// Nonce of a chunk of a stream, which is the stream's nonce prefix, followed by the chunk's
+// index, followed by a flag that is set only on the final chunk so that truncation of the
+// stream is detected
+func cryptChunkNonce(prefix []byte, index uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[cryptStreamNonceSize:], index)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Writer that encrypts a stream in chunks
+type cryptStreamWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint32
+	buf    []byte
+}
+
+// Create a writer that encrypts what is written to it.  Closing the writer writes the final
+// chunk, without closing the underlying writer.
+func newCryptStreamWriter(w io.Writer, key []byte) (writer *cryptStreamWriter, err error) {
+	writer = &cryptStreamWriter{w: w}
+	writer.aead, err = cryptNewGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	writer.prefix = make([]byte, cryptStreamNonceSize)
+	_, err = rand.Read(writer.prefix)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(writer.prefix)
+	if err != nil {
+		return nil, err
+	}
+	writer.buf = make([]byte, 0, cryptChunkSize)
+	return writer, nil
+}
+
+// Write buffers plaintext, writing each chunk as it fills
+func (writer *cryptStreamWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+
+		// Write the buffered chunk only once more data arrives, so that we know it isn't final
+		if len(writer.buf) == cryptChunkSize {
+			err = writer.writeChunk(false)
+			if err != nil {
+				return
+			}
+		}
+		copied := copy(writer.buf[len(writer.buf):cryptChunkSize], p)
+		writer.buf = writer.buf[:len(writer.buf)+copied]
+		p = p[copied:]
+		n += copied
+	}
+	return
+}
+
+// Write the buffered chunk
+func (writer *cryptStreamWriter) writeChunk(final bool) (err error) {
+	nonce := cryptChunkNonce(writer.prefix, writer.index, final)
+	_, err = writer.w.Write(writer.aead.Seal(nil, nonce, writer.buf, nil))
+	writer.index++
+	writer.buf = writer.buf[:0]
+	return
+}
+
+// Close writes the final chunk
+func (writer *cryptStreamWriter) Close() (err error) {
+	return writer.writeChunk(true)
+}
+
+// Reader that decrypts a stream written by cryptStreamWriter, at random offsets
+type cryptStreamReader struct {
+	r          io.ReaderAt
+	aead       cipher.AEAD
+	prefix     []byte
+	chunks     int64
+	cipherSize int64
+	size       int64
+}
+
+// Create a reader of an encrypted stream of the specified total size
+func newCryptStreamReader(r io.ReaderAt, cipherSize int64, key []byte) (reader *cryptStreamReader, err error) {
+	reader = &cryptStreamReader{r: r}
+	reader.aead, err = cryptNewGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	reader.prefix = make([]byte, cryptStreamNonceSize)
+	_, err = r.ReadAt(reader.prefix, 0)
+	if err != nil {
+		return nil, fmt.Errorf("encrypted stream is too short")
+	}
+	sealedChunkSize := int64(cryptChunkSize + reader.aead.Overhead())
+	reader.cipherSize = cipherSize - cryptStreamNonceSize
+	reader.chunks = (reader.cipherSize + sealedChunkSize - 1) / sealedChunkSize
+	if reader.chunks == 0 {
+		return nil, fmt.Errorf("encrypted stream is too short")
+	}
+	reader.size = reader.cipherSize - reader.chunks*int64(reader.aead.Overhead())
+	if reader.size < 0 {
+		return nil, fmt.Errorf("encrypted stream is too short")
+	}
+	return reader, nil
+}
+
+// Size returns the size of the decrypted stream
+func (reader *cryptStreamReader) Size() int64 {
+	return reader.size
+}
+
+// ReadAt decrypts the chunks overlapping the requested range
+func (reader *cryptStreamReader) ReadAt(p []byte, off int64) (n int, err error) {
+	sealedChunkSize := int64(cryptChunkSize + reader.aead.Overhead())
+	for len(p) > 0 {
+		if off >= reader.size {
+			return n, io.EOF
+		}
+		index := off / cryptChunkSize
+		sealedOffset := cryptStreamNonceSize + index*sealedChunkSize
+		sealedLength := sealedChunkSize
+		if index*sealedChunkSize+sealedLength > reader.cipherSize {
+			sealedLength = reader.cipherSize - index*sealedChunkSize
+		}
+		sealed := make([]byte, sealedLength)
+		_, err = reader.r.ReadAt(sealed, sealedOffset)
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		nonce := cryptChunkNonce(reader.prefix, uint32(index), index == reader.chunks-1)
+		chunk, err := reader.aead.Open(nil, nonce, sealed, nil)
+		if err != nil {
+			return n, fmt.Errorf("can't decrypt chunk %d: %s", index, err)
+		}
+		copied := copy(p, chunk[off-index*cryptChunkSize:])
+		p = p[copied:]
+		off += int64(copied)
+		n += copied
+	}
+	return n, nil
+}
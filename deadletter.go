@@ -0,0 +1,185 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Dead letter directory, holding batches whose upload failed too many times and events that
+// could not be archived, so that they neither block nor are silently lost from the archive.
+// Each entry is a directory, within the archive's deadletter directory, containing the
+// spool segments of the events along with an error.txt file explaining why they are there.
+// Entries may be inspected, and requeued once the problem has been fixed.
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Name of the dead letter directory within an archive's data directory
+const instanceDeadLetter = "/deadletter/"
+
+// Suffix of the names of entries holding events that could not be archived
+const deadLetterPoisonSuffix = ".poison"
+
+// An entry in the dead letter directory
+type deadLetterEntry struct {
+	Name   string
+	Count  int
+	Reason string
+}
+
+// Path of an entry's directory
+func deadLetterPath(archiveID string, entryName string) string {
+	return configDataPath(archiveID+instanceDeadLetter) + entryName + "/"
+}
+
+// Move a batch whose upload has repeatedly failed into the dead letter directory
+func deadLetterBatch(archiveID string, folder string, entryName string, segments []spoolSegment, reason string) (err error) {
+	entryPath := deadLetterPath(archiveID, entryName)
+	err = os.MkdirAll(entryPath, 0777)
+	if err == nil {
+		err = writeFileAtomic(entryPath+instanceRouteErrorFile, []byte(reason))
+	}
+	if err == nil {
+		err = spoolMove(archiveID, folder, segments, entryPath)
+	}
+	if err != nil {
+		return fmt.Errorf("can't move %s to dead letter: %s", entryName, err)
+	}
+	fmt.Printf("archive: %s moved '%s' to dead letter: %s\n", archiveID, entryName, reason)
+	return nil
+}
+
+// Copy events that could not be archived into the dead letter directory
+func deadLetterPoison(archiveID string, folder string, entryName string, records []spoolRecord, reasons []string) (err error) {
+	entryName += deadLetterPoisonSuffix
+	entryPath := deadLetterPath(archiveID, entryName)
+	err = os.MkdirAll(entryPath, 0777)
+	if err == nil {
+		err = writeFileAtomic(entryPath+instanceRouteErrorFile, []byte(strings.Join(reasons, "\n")))
+	}
+	if err == nil {
+		err = spoolWriteSegment(entryPath, folder, records)
+	}
+	if err != nil {
+		return fmt.Errorf("can't move events that could not be archived to dead letter: %s", err)
+	}
+	fmt.Printf("archive: %s moved %d events that could not be archived to dead letter '%s'\n", archiveID, len(records), entryName)
+	return nil
+}
+
+// Move an event that lacks the time specified by its route's time_basis into the dead letter
+// directory, filed by its received time so that it is archived as such if it is requeued.
+// The entry is named for the event, so that retries of the event replace it.
+func deadLetterUntimed(archiveID string, folder string, receivedUs int64, eventUID string, eventJSON []byte, reason string) (err error) {
+	payload, err := atRestSeal(archiveID, eventJSON)
+	if err != nil {
+		return err
+	}
+	record := spoolRecord{ReceivedUs: receivedUs, UIDHash: spoolUIDHash(eventUID), EventJSON: payload}
+	entryName := fmt.Sprintf("%s %d-%016x", folder, receivedUs, record.UIDHash)
+	return deadLetterPoison(archiveID, folder, entryName, []spoolRecord{record}, []string{reason})
+}
+
+// List an archive's dead letter entries
+func deadLetterEntries(archiveID string) (entries []deadLetterEntry, err error) {
+	files, err := os.ReadDir(configDataPath(archiveID + instanceDeadLetter))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		entry := deadLetterEntry{Name: file.Name()}
+		entryPath := deadLetterPath(archiveID, entry.Name)
+		reason, _ := os.ReadFile(entryPath + instanceRouteErrorFile)
+		entry.Reason = string(reason)
+		segmentFiles, _ := os.ReadDir(entryPath)
+		for _, segmentFile := range segmentFiles {
+			if strings.HasSuffix(segmentFile.Name(), spoolIndexSuffix) {
+				receivedUs, _, _ := spoolReadIndex(entryPath + strings.TrimSuffix(segmentFile.Name(), spoolIndexSuffix))
+				entry.Count += len(receivedUs)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+// Print the dead letter entries of every archive
+func deadLetterList() {
+	dataDir, err := os.ReadDir(configDataPath(""))
+	if err != nil {
+		fmt.Printf("data directory read error: %s\n", err)
+		return
+	}
+	total := 0
+	for _, archiveIDFile := range dataDir {
+		if !archiveIDFile.IsDir() {
+			continue
+		}
+		entries, _ := deadLetterEntries(archiveIDFile.Name())
+		for _, entry := range entries {
+			fmt.Printf("%s '%s' (%d events): %s\n", archiveIDFile.Name(), entry.Name, entry.Count, strings.ReplaceAll(entry.Reason, "\n", "; "))
+			total++
+		}
+	}
+	if total == 0 {
+		fmt.Printf("dead letter is empty\n")
+	}
+}
+
+// Print the events of a dead letter entry
+func deadLetterShow(archiveID string, entryName string) (err error) {
+	entryPath := deadLetterPath(archiveID, entryName)
+	files, err := os.ReadDir(entryPath)
+	if err != nil {
+		return fmt.Errorf("no such entry: %s", entryName)
+	}
+	reason, _ := os.ReadFile(entryPath + instanceRouteErrorFile)
+	fmt.Printf("%s\n", reason)
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), spoolLogSuffix) {
+			continue
+		}
+		err = spoolReadSegment(entryPath+strings.TrimSuffix(file.Name(), spoolLogSuffix), func(record spoolRecord) error {
+			eventJSON, err := atRestOpen(archiveID, record.EventJSON)
+			if err != nil {
+				fmt.Printf("(%s)\n", err)
+				return nil
+			}
+			fmt.Printf("%s\n", eventJSON)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("error reading %s: %s", file.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Move the events of a dead letter entry back into the spool so that they will be archived
+func deadLetterRequeue(archiveID string, entryName string) (err error) {
+	entryPath := deadLetterPath(archiveID, entryName)
+	_, err = os.Stat(entryPath)
+	if err != nil {
+		return fmt.Errorf("no such entry: %s", entryName)
+	}
+	count, err := spoolRestore(archiveID, entryPath)
+	if err != nil {
+		return fmt.Errorf("can't requeue %s: %s", entryName, err)
+	}
+	os.Remove(entryPath + instanceRouteErrorFile)
+	err = os.Remove(entryPath)
+	if err != nil {
+		return fmt.Errorf("requeued %d events but can't remove %s: %s", count, entryName, err)
+	}
+	fmt.Printf("archive: %s requeued %d events from '%s'\n", archiveID, count, entryName)
+	archiveNotify(archiveID)
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Expansion of the file_folder template into the folder for an event
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/blues/note-go/note"
+)
+
+// Value substituted for a token whose event field is empty, so that events missing
+// a field are filed together rather than producing an empty path component
+const folderTokenMissing = "unknown"
+
+// Tokens that may be used in folder templates
+var folderTemplateTokens = []string{
+	"[id]", "[file]", "[device]", "[product]", "[sn]", "[app]", "[project]", "[fleet]",
+	"[year]", "[month]", "[day]", "[hour]", "[minute]", "[second]", "[weeknum]",
+}
+
+// Determine whether or not a token may be used in folder templates
+func folderTokenValid(token string) bool {
+	for _, t := range folderTemplateTokens {
+		if token == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Event fields that may be used in folder templates but that aren't in note.Event
+type folderEventExtras struct {
+	Fleets []string `json:"fleets,omitempty"`
+}
+
+// Values substituted for each [token] of a folder template for an event
+func folderTokenValues(archiveID string, event note.Event, eventJSON []byte, t time.Time) (values map[string]string) {
+
+	var extras folderEventExtras
+	note.JSONUnmarshal(eventJSON, &extras)
+	fleetUID := ""
+	if len(extras.Fleets) > 0 {
+		fleetUID = extras.Fleets[0]
+	}
+	appUID := ""
+	projectName := ""
+	if event.App != nil {
+		appUID = event.App.AppUID
+		projectName = event.App.AppLabel
+	}
+
+	// Substitute fields of the event, making sure that they can't introduce subfolders
+	fields := map[string]string{
+		"[id]":      archiveID,
+		"[file]":    event.NotefileID,
+		"[device]":  event.DeviceUID,
+		"[product]": event.ProductUID,
+		"[sn]":      event.DeviceSN,
+		"[app]":     appUID,
+		"[project]": projectName,
+		"[fleet]":   fleetUID,
+	}
+	values = map[string]string{}
+	for token, value := range fields {
+		value = strings.ReplaceAll(value, "/", "-")
+		if value == "" {
+			value = folderTokenMissing
+		}
+		values[token] = value
+	}
+
+	// Substitute the time
+	values["[year]"] = fmt.Sprintf("%04d", t.Year())
+	values["[month]"] = fmt.Sprintf("%02d", t.Month())
+	values["[day]"] = fmt.Sprintf("%02d", t.Day())
+	values["[hour]"] = fmt.Sprintf("%02d", t.Hour())
+	values["[minute]"] = fmt.Sprintf("%02d", t.Minute())
+	values["[second]"] = fmt.Sprintf("%02d", t.Second())
+	values["[weeknum]"] = fmt.Sprintf("%02d", (t.YearDay()-1)/7+1)
+
+	return values
+
+}
+
+// Substitute the values of a template's tokens in a single pass, so that values containing
+// brackets aren't re-expanded
+func substituteFolderTokens(template string, values map[string]string) string {
+	pairs := []string{}
+	for token, value := range values {
+		pairs = append(pairs, token, value)
+	}
+	return strings.NewReplacer(pairs...).Replace(template)
+}
+
+// Expand the folder template for an event, substituting each [token]
+func expandFolderTemplate(template string, archiveID string, event note.Event, eventJSON []byte, t time.Time) (folder string) {
+	return substituteFolderTokens(template, folderTokenValues(archiveID, event, eventJSON, t))
+}
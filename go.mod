@@ -3,8 +3,22 @@ module github.com/blues/archive
 go 1.17
 
 require (
-	github.com/aws/aws-sdk-go v1.44.77 // indirect
-	github.com/blues/note-go v1.5.0 // indirect
-	github.com/google/uuid v1.3.0 // indirect
+	github.com/aws/aws-sdk-go v1.44.77
+	github.com/blues/note-go v1.5.0
+	github.com/google/uuid v1.3.0
+	github.com/klauspost/compress v1.15.9
+	github.com/linkedin/goavro/v2 v2.12.0
+	github.com/xitongsys/parquet-go v1.6.2
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
+	go.etcd.io/bbolt v1.3.7
+)
+
+require (
+	github.com/apache/arrow/go/arrow v0.0.0-20200730104253-651201b0f516 // indirect
+	github.com/apache/thrift v0.14.2 // indirect
+	github.com/golang/snappy v0.0.3 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/pierrec/lz4/v4 v4.1.8 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+	golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543 // indirect
 )
@@ -0,0 +1,98 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Serves queries of the catalog of uploaded archives
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/blues/note-go/note"
+)
+
+// Maximum number of entries returned by a single query
+const catalogMaxLimit = 10000
+
+// Catalog handler, which takes the archive_id and optional prefix, device, since, and until
+// (RFC3339), and limit as query parameters.  The catalog is only available for archives that
+// have a secret, which must be presented in the archive_secret header or as a bearer token,
+// because a signature of the request's empty body would be the same for every request.
+func inboundWebCatalogHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Authorize the request against the archive's secret
+	params := r.URL.Query()
+	archiveID := params.Get("archive_id")
+	if archiveID == "" {
+		writeErr(w, "archive_id must be specified")
+		return
+	}
+	err := validArchiveID(archiveID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeErr(w, err.Error())
+		return
+	}
+	archiveSecret := ""
+	rc, err := archiveRouteConfig(archiveID)
+	if err == nil {
+		archiveSecret = rc.ArchiveSecret
+	}
+	if archiveSecret == "" {
+		w.WriteHeader(http.StatusNotFound)
+		writeErr(w, "archive_id doesn't exist or has no archive_secret")
+		return
+	}
+	if !requestPresentsSecret(r, archiveSecret) {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeErr(w, "archive_secret is missing or incorrect")
+		return
+	}
+
+	// Parse the query
+	query := catalogQuery{ArchiveID: archiveID, Limit: catalogMaxLimit}
+	query.Prefix = params.Get("prefix")
+	query.Device = params.Get("device")
+	if params.Get("since") != "" {
+		query.Since, err = time.Parse(time.RFC3339, params.Get("since"))
+		if err != nil {
+			writeErr(w, "since must be an RFC3339 time")
+			return
+		}
+	}
+	if params.Get("until") != "" {
+		query.Until, err = time.Parse(time.RFC3339, params.Get("until"))
+		if err != nil {
+			writeErr(w, "until must be an RFC3339 time")
+			return
+		}
+	}
+	if params.Get("limit") != "" {
+		query.Limit, err = strconv.Atoi(params.Get("limit"))
+		if err != nil || query.Limit < 1 || query.Limit > catalogMaxLimit {
+			writeErr(w, fmt.Sprintf("limit must be from 1 to %d", catalogMaxLimit))
+			return
+		}
+	}
+
+	// Write the matching entries
+	entries, err := catalogFind(query)
+	if err != nil {
+		writeErr(w, err.Error())
+		return
+	}
+	if entries == nil {
+		entries = []catalogEntry{}
+	}
+	rspJSON, err := note.JSONMarshal(map[string]interface{}{"objects": entries})
+	if err != nil {
+		writeErr(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(rspJSON)
+
+}
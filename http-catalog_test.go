@@ -0,0 +1,60 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestCatalogHandlerAuthorization(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	rc := RouteConfig{ArchiveID: "test", ArchiveSecret: "secret", SinkType: sinkTypeFile, BucketName: "test"}
+	err := writeRouteConfig(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte(rc.ArchiveSecret))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	// Only the secret itself is accepted, and archive IDs that aren't valid are rejected
+	// before anything is read from or created on disk
+	tests := []struct {
+		archiveID string
+		header    string
+		value     string
+		status    int
+	}{
+		{"test", "Authorization", "Bearer secret", http.StatusOK},
+		{"test", authSecretHeader, "secret", http.StatusOK},
+		{"test", "Authorization", "Bearer wrong", http.StatusUnauthorized},
+		{"test", authSignatureHeader, "sha256=" + signature, http.StatusUnauthorized},
+		{"other", "Authorization", "Bearer secret", http.StatusNotFound},
+		{"../escape", "Authorization", "Bearer secret", http.StatusBadRequest},
+		{"a/b", "Authorization", "Bearer secret", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/catalog?archive_id="+url.QueryEscape(test.archiveID), nil)
+		r.Header.Set(test.header, test.value)
+		w := httptest.NewRecorder()
+		inboundWebCatalogHandler(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s: expected status %d, got %d %s", test.archiveID, test.header, test.status, w.Code, w.Body.String())
+		}
+	}
+	if _, err := os.Stat(home + "/escape"); err == nil {
+		t.Errorf("expected no directory to be created outside the data directory")
+	}
+	if _, err := os.Stat(configDataPath("") + "a"); err == nil {
+		t.Errorf("expected no directory to be created for an invalid archive_id")
+	}
+}
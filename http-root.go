@@ -11,33 +11,19 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/blues/note-go/note"
-	"github.com/google/uuid"
 )
 
 // File folders/names
 const instanceRouteConfigFile = "route.json"
 const instanceRouteErrorFile = "error.txt"
 const instanceIncomingEvents = "/incoming/"
-
-// Configuration object
-type RouteConfig struct {
-	ArchiveID           string `json:"archive_id"`
-	ArchiveCountExceeds int    `json:"archive_count_exceeds"`
-	ArchiveEveryMins    int    `json:"archive_every_mins"`
-	BucketEndpoint      string `json:"bucket_endpoint"`
-	BucketName          string `json:"bucket_name"`
-	BucketRegion        string `json:"bucket_region"`
-	FileAccess          string `json:"file_access"`
-	FileFormat          string `json:"file_format"`
-	FileFolder          string `json:"file_folder"`
-	KeyID               string `json:"key_id"`
-	KeySecret           string `json:"key_secret"`
-}
+const instanceUploads = "/uploads/"
 
 // Root handler
 func inboundWebRootHandler(w http.ResponseWriter, r *http.Request) {
@@ -65,138 +51,82 @@ func inboundWebRootHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var exists bool
+	// Archives defined in the server's config store are authorized using their stored
+	// secret, and take their config from the store rather than from the request's headers,
+	// except for those headers that the archive permits to override the stored config.
 	var rc RouteConfig
-	rc.ArchiveID, exists = headerField(r, "archive_id")
-	if !exists {
-		writeErr(w, "archive_id not specified")
-		return
-	}
-	s, _ := headerField(r, "archive_every_mins")
-	rc.ArchiveEveryMins, _ = strconv.Atoi(s)
-	if rc.ArchiveEveryMins <= 0 {
-		rc.ArchiveEveryMins = 1440
-	}
-	if rc.ArchiveEveryMins > 10080 {
-		writeErr(w, "maximum minutes per file is 10080 (1 week)")
-		return
-	}
-	s, _ = headerField(r, "archive_count_exceeds")
-	rc.ArchiveCountExceeds, _ = strconv.Atoi(s)
-	if rc.ArchiveCountExceeds <= 0 {
-		rc.ArchiveCountExceeds = 1000
-	}
-	if rc.ArchiveCountExceeds > 25000 {
-		writeErr(w, "maximum count of events per file is 25000")
-		return
-	}
-
-	rc.BucketEndpoint, _ = headerField(r, "bucket_endpoint")
-
-	rc.BucketName, exists = headerField(r, "bucket_name")
-	if !exists {
-		writeErr(w, "bucket_name not specified")
-		return
-	}
-
-	rc.BucketRegion, exists = headerField(r, "bucket_region")
-	if !exists {
-		writeErr(w, "bucket_region not specified")
-		return
-	}
-
-	rc.FileAccess, exists = headerField(r, "file_access")
-	if !exists {
-		writeErr(w, "file_access not specified")
-		return
-	}
-
-	rc.FileFormat, exists = headerField(r, "file_format")
-	if !exists {
-		rc.FileFormat = "[id]/[year]-[month]"
-	}
-	if strings.Contains(rc.FileFormat, " ") {
-		writeErr(w, "file_format may not contain a space character")
-		return
-	}
-
-	rc.FileFolder, exists = headerField(r, "file_folder")
-	if !exists {
-		writeErr(w, "file_folder not specified")
-		return
-	}
-
-	rc.KeyID, exists = headerField(r, "key_id")
-	if !exists {
-		writeErr(w, "key_id not specified")
-		return
-	}
-	rc.KeySecret, exists = headerField(r, "key_secret")
-	if !exists {
-		writeErr(w, "key_secret not specified")
-		return
-	}
+	archiveID, _ := headerField(r, "archive_id")
+	archive, isStored, storedOnly := storedArchiveConfig(archiveID)
+	if isStored {
+		if !requestAuthorized(r, eventJSON, archive.ArchiveSecret) {
+			w.WriteHeader(http.StatusUnauthorized)
+			writeErr(w, "archive_secret or archive_signature is missing or incorrect")
+			return
+		}
+		overrides := storedOverrides(r, archive)
+		rc, err = storedRouteConfig(archiveID, archive, overrides)
+		if err != nil {
+			writeErr(w, err.Error())
+			return
+		}
 
-	// Atomically write configuration to a config file if it's changed
-	rcJSON, err := note.JSONMarshal(rc)
-	if err != nil {
-		fmt.Printf("error marshaling route config: %s\n", err)
-	} else {
-		filePath := configDataPath(rc.ArchiveID) + instanceRouteConfigFile
-		existingJSON, err := os.ReadFile(filePath)
-		if err != nil || string(existingJSON) != string(rcJSON) {
-			tempFile := uuid.New().String() + ".temp"
-			tempPath := configDataPath(rc.ArchiveID) + tempFile
-			err := os.WriteFile(tempPath, rcJSON, 0644)
+		// Save the overrides if they've changed, so that the archive is uploaded using them.
+		// Any route config saved before the archive was added to the store is removed, because
+		// it may hold credentials that are now kept only in the store.
+		existingOverrides, err := readStoredOverrides(archiveID)
+		if err != nil || !reflect.DeepEqual(existingOverrides, overrides) {
+			err = writeStoredOverrides(archiveID, overrides)
 			if err != nil {
-				fmt.Printf("error writing route config to %s: %s\n", tempPath, err)
-			} else {
-				err = os.Rename(tempPath, filePath)
-				if err != nil {
-					fmt.Printf("error renaming %s to %s\n", tempPath, filePath)
-				}
+				fmt.Printf("error writing overrides for %s: %s\n", archiveID, err)
 			}
 		}
-	}
-
-	// Compute the int64 received date in a way that doesn't exceed float64 digits
-	receivedUs := receivedAsInt64(event.Received)
-
-	// Generate the key name for this event
-	bucketKey := fmt.Sprintf("%s/%d", rc.FileFolder, receivedUs)
-	bucketKey = strings.ReplaceAll(bucketKey, "[file]", event.NotefileID)
-	bucketKey = strings.ReplaceAll(bucketKey, "[id]", rc.ArchiveID)
-	receivedTime := time.Unix(0, 1000*receivedUs)
-	s = fmt.Sprintf("%04d", receivedTime.Year())
-	bucketKey = strings.ReplaceAll(bucketKey, "[year]", s)
-	s = fmt.Sprintf("%02d", receivedTime.Month())
-	bucketKey = strings.ReplaceAll(bucketKey, "[month]", s)
-	s = fmt.Sprintf("%02d", receivedTime.Day())
-	bucketKey = strings.ReplaceAll(bucketKey, "[day]", s)
-	s = fmt.Sprintf("%02d", receivedTime.Hour())
-	bucketKey = strings.ReplaceAll(bucketKey, "[hour]", s)
-	s = fmt.Sprintf("%02d", receivedTime.Minute())
-	bucketKey = strings.ReplaceAll(bucketKey, "[minute]", s)
-	s = fmt.Sprintf("%02d", receivedTime.Second())
-	bucketKey = strings.ReplaceAll(bucketKey, "[second]", s)
-	s = fmt.Sprintf("%02d", (receivedTime.YearDay()-1)/7+1)
-	bucketKey = strings.ReplaceAll(bucketKey, "[weeknum]", s)
-
-	// Clean to remove characters that are not allowed in a bucket key
-	bucketKey = cleanKey(bucketKey)
+		os.Remove(configDataPath(archiveID) + instanceRouteConfigFile)
+	} else {
+		if storedOnly {
+			writeErr(w, "archive_id is not configured on this server")
+			return
+		}
+		rc, err = routeConfigFromRequest(r)
+		if err != nil {
+			writeErr(w, err.Error())
+			return
+		}
 
-	// Substitute slashes with space, which will be restored later
-	bucketKey = strings.ReplaceAll(bucketKey, "/", " ")
+		// If a secret has been pinned for this archive, make sure that the request is authorized
+		// before doing anything else, so that strangers can't replace the route's config.  If not,
+		// pin the secret presented by this request, if any.  A config that exists but can't be
+		// read may have a secret pinned, so the request is refused rather than being allowed
+		// to replace it.
+		existingRC, err := readRouteConfig(rc.ArchiveID)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("error reading route config for %s: %s\n", rc.ArchiveID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			writeErr(w, "archive_id's route config can't be read")
+			return
+		}
+		if err == nil && existingRC.ArchiveSecret != "" {
+			if !requestAuthorized(r, eventJSON, existingRC.ArchiveSecret) {
+				w.WriteHeader(http.StatusUnauthorized)
+				writeErr(w, "archive_secret or archive_signature is missing or incorrect")
+				return
+			}
+			rc.ArchiveSecret = existingRC.ArchiveSecret
+		} else {
+			rc.ArchiveSecret = requestSecret(r)
+		}
 
-	// Write the event in an atomic way
-	filePath := configDataPath(rc.ArchiveID+instanceIncomingEvents) + bucketKey
-	err = os.WriteFile(filePath, eventJSON, 0644)
-	if err != nil {
-		fmt.Printf("error writing %s: %s\n", filePath, err)
+		// Atomically write configuration to a config file if it's changed.  Configs are compared
+		// after decryption, because encrypted fields differ each time they are encrypted.
+		if err != nil || existingRC != rc {
+			err = writeRouteConfig(rc)
+			if err != nil {
+				fmt.Printf("error writing route config for %s: %s\n", rc.ArchiveID, err)
+			}
+		}
 	}
 
-	// Signal that there's new incoming, to wake up the archiver
-	archiveIncoming.Signal()
+	// Spool the event for archiving
+	spoolRouteEvent(rc, event, eventJSON)
 
 	// If a routing error occurred, indicate as such
 	errorMsg, err := os.ReadFile(configDataPath(rc.ArchiveID) + instanceRouteErrorFile)
@@ -210,6 +140,51 @@ func inboundWebRootHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// Spool an event for archiving by the route, in the folder determined by its time
+func spoolRouteEvent(rc RouteConfig, event note.Event, eventJSON []byte) {
+
+	// Determine the time by which the event is archived, which is its received time if it
+	// lacks the time specified by the route's time_basis
+	eventUs, timePresent := eventTimeUs(rc, event)
+
+	// Generate the folder name for this event, cleaned to remove characters that are not
+	// allowed in a bucket key
+	eventTime := time.Unix(0, 1000*eventUs)
+	var folder string
+	if rc.FilePartition == filePartitionHive {
+		folder = expandHiveFolderTemplate(rc.FileFolder, rc.ArchiveID, event, eventJSON, eventTime)
+	} else {
+		folder = cleanKey(expandFolderTemplate(rc.FileFolder, rc.ArchiveID, event, eventJSON, eventTime))
+	}
+
+	// Substitute slashes with space, which will be restored later
+	folder = strings.ReplaceAll(folder, "/", " ")
+
+	// Append the event to the folder's spool, ignoring it if it is a retry of an event that
+	// we have already received.  Events lacking their time are instead skipped or moved to
+	// the dead letter directory if the route's time_missing says so.
+	switch {
+	case !timePresent && rc.TimeMissing == timeMissingSkip:
+		fmt.Printf("archive: %s skipping event %s that lacks a %s time\n", rc.ArchiveID, event.EventUID, rc.TimeBasis)
+	case !timePresent && rc.TimeMissing == timeMissingDeadLetter:
+		err := deadLetterUntimed(rc.ArchiveID, folder, eventUs, event.EventUID, eventJSON, fmt.Sprintf("event lacks a %s time", rc.TimeBasis))
+		if err != nil {
+			fmt.Printf("archive: %s: %s\n", rc.ArchiveID, err)
+		}
+	default:
+		added, batch, err := spoolAppend(rc.ArchiveID, folder, eventUs, event.EventUID, eventJSON)
+		if err != nil {
+			fmt.Printf("error spooling event for %s: %s\n", rc.ArchiveID, err)
+		} else if !added {
+			fmt.Printf("archive: %s ignoring duplicate event %s\n", rc.ArchiveID, event.EventUID)
+		} else {
+			// Let the archiver know when the folder becomes due, waking it if that's now
+			archiveNotifyDue(rc.ArchiveID, batch.dueTime(rc))
+		}
+	}
+
+}
+
 // Safely convert a floating received date/time to int64
 func receivedAsInt64(received float64) int64 {
 	i64, _ := strconv.ParseInt(strings.ReplaceAll(fmt.Sprintf("%.6f", received), ".", ""), 10, 0)
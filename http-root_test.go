@@ -0,0 +1,156 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blues/note-go/note"
+)
+
+// Spool an event as if it had been routed to the archive
+func spoolTestEvent(t *testing.T, rc RouteConfig, eventJSON string) {
+	var event note.Event
+	err := note.JSONUnmarshal([]byte(eventJSON), &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spoolRouteEvent(rc, event, []byte(eventJSON))
+}
+
+func TestSpoolRouteEventTimeMissing(t *testing.T) {
+	tests := []struct {
+		timeMissing string
+		spooled     int
+		deadLetter  int
+	}{
+		{timeMissingReceived, 1, 0},
+		{timeMissingSkip, 0, 0},
+		{timeMissingDeadLetter, 0, 1},
+	}
+	for _, test := range tests {
+		t.Setenv("HOME", t.TempDir())
+		spoolFolders = map[spoolFolderKey]*spoolFolder{}
+		spoolLoaded = map[string]bool{}
+		rc := RouteConfig{ArchiveID: "test", ArchiveEveryMins: 60, ArchiveCountExceeds: 10, FileFolder: "[year]",
+			TimeBasis: timeBasisWhen, TimeMissing: test.timeMissing}
+		err := writeRouteConfig(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Events having their time are always spooled, in the folder for that time, while
+		// those lacking it are handled as the route's time_missing says
+		spoolTestEvent(t, rc, `{"event":"e1","received":1656000000,"when":1600000000}`)
+		spoolTestEvent(t, rc, `{"event":"e2","received":1656000000}`)
+		timed, _ := spoolFolderSegments(rc.ArchiveID, "2020")
+		untimed, _ := spoolFolderSegments(rc.ArchiveID, "2022")
+		if len(timed) != 1 || timed[0].Count != 1 {
+			t.Errorf("%s: expected the timed event to be spooled, got %+v", test.timeMissing, timed)
+		}
+		count := 0
+		for _, segment := range untimed {
+			count += segment.Count
+		}
+		if count != test.spooled {
+			t.Errorf("%s: expected %d untimed events to be spooled, got %d", test.timeMissing, test.spooled, count)
+		}
+		entries, _ := deadLetterEntries(rc.ArchiveID)
+		if len(entries) != test.deadLetter {
+			t.Errorf("%s: expected %d dead letter entries, got %+v", test.timeMissing, test.deadLetter, entries)
+		}
+		for _, entry := range entries {
+			if entry.Count != 1 || !strings.Contains(entry.Reason, timeBasisWhen) {
+				t.Errorf("%s: unexpected dead letter entry %+v", test.timeMissing, entry)
+			}
+		}
+	}
+}
+
+func TestArchiveKeysOfSameTimeAreUnique(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	spoolFolders = map[spoolFolderKey]*spoolFolder{}
+	spoolLoaded = map[string]bool{}
+	rc := RouteConfig{ArchiveID: "test", ArchiveEveryMins: 60, ArchiveCountExceeds: 1, FileFolder: "events",
+		FileFormat: "ndjson", TimeBasis: timeBasisWhen, SinkType: sinkTypeFile, BucketName: "test",
+		UploadMaxAttempts: 1, UploadTimeoutMins: 1}
+	err := writeRouteConfig(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Batches of single events whose times have the same second are archived separately
+	// rather than the second replacing the first
+	when := time.Now().Unix() - 60
+	for i := 1; i <= 2; i++ {
+		spoolTestEvent(t, rc, fmt.Sprintf(`{"event":"e%d","received":%d,"when":%d}`, i, when+1, when))
+		performArchive(rc.ArchiveID)
+	}
+	sink, _ := newFileSink(rc)
+	objects, err := sink.ListObjects(context.Background(), "events/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, object := range objects {
+		if !strings.Contains(object.Key, manifestDirName) {
+			keys = append(keys, object.Key)
+		}
+	}
+	prefix := fmt.Sprintf("events/%d-%d-1-", when*1000000, when*1000000)
+	if len(keys) != 2 || !strings.HasPrefix(keys[0], prefix) || !strings.HasPrefix(keys[1], prefix) {
+		t.Errorf("expected two archives named %s..., got %v", prefix, keys)
+	}
+	manifests := readTestManifest(t, sink, "events")
+	if len(manifests) != 2 {
+		t.Errorf("expected both archives to be listed, got %+v", manifests)
+	}
+}
+
+func TestRootHandlerRefusesUnreadableConfig(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(fileSinkEnv, "true")
+	spoolFolders = map[spoolFolderKey]*spoolFolder{}
+	spoolLoaded = map[string]bool{}
+	routeJSONPath := configDataPath("test") + instanceRouteConfigFile
+	send := func(secret string) int {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"event":"e1","received":1656000000}`))
+		r.Header.Set("archive_id", "test")
+		r.Header.Set("sink_type", sinkTypeFile)
+		r.Header.Set("bucket_name", "test")
+		r.Header.Set(authSecretHeader, secret)
+		w := httptest.NewRecorder()
+		inboundWebRootHandler(w, r)
+		return w.Code
+	}
+
+	// The first request pins its secret, after which another secret is refused
+	if status := send("secret"); status != http.StatusOK {
+		t.Fatalf("expected first request to succeed, got %d", status)
+	}
+	if status := send("other"); status != http.StatusUnauthorized {
+		t.Errorf("expected request with another secret to be refused, got %d", status)
+	}
+
+	// A config that can't be read isn't replaced by the next request's secret
+	err := os.WriteFile(routeJSONPath, []byte("{"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := send("other"); status != http.StatusInternalServerError {
+		t.Errorf("expected request to be refused when config can't be read, got %d", status)
+	}
+	routeJSON, _ := os.ReadFile(routeJSONPath)
+	if string(routeJSON) != "{" {
+		t.Errorf("expected unreadable config to be left alone, got %s", routeJSON)
+	}
+}
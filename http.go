@@ -16,6 +16,7 @@ func HTTPInboundHandler(port string) {
 	// Topics
 	http.HandleFunc("/github", inboundWebGithubHandler)
 	http.HandleFunc("/ping", inboundWebPingHandler)
+	http.HandleFunc("/catalog", inboundWebCatalogHandler)
 	http.HandleFunc("/", inboundWebRootHandler)
 
 	// HTTP
@@ -70,6 +70,69 @@ func inputHandler() {
 		case "q":
 			os.Exit(0)
 
+		case "reload":
+			err := routeStoreLoad()
+			if err == nil {
+				fmt.Printf("reloaded %s\n", routeStorePath())
+			}
+
+		case "decrypt":
+			if len(args) < 3 || len(args) > 4 {
+				fmt.Printf("usage: decrypt <private-key.pem> <archive.enc> [output]\n")
+				break
+			}
+			outPath := ""
+			if len(args) == 4 {
+				outPath = args[3]
+			}
+			err := decryptArchive(arg1, arg2, outPath)
+			if err != nil {
+				fmt.Printf("decrypt: %s\n", err)
+			}
+
+		case "deadletter":
+			if len(args) < 3 {
+				deadLetterList()
+				break
+			}
+			err := deadLetterShow(arg1, strings.Join(args[2:], " "))
+			if err != nil {
+				fmt.Printf("deadletter: %s\n", err)
+			}
+
+		case "requeue":
+			if len(args) < 3 {
+				fmt.Printf("usage: requeue <archive_id> <entry>|all\n")
+				break
+			}
+			entryNames := []string{strings.Join(args[2:], " ")}
+			if entryNames[0] == "all" {
+				entryNames = nil
+				entries, _ := deadLetterEntries(arg1)
+				for _, entry := range entries {
+					entryNames = append(entryNames, entry.Name)
+				}
+			}
+			for _, entryName := range entryNames {
+				err := deadLetterRequeue(arg1, entryName)
+				if err != nil {
+					fmt.Printf("requeue: %s\n", err)
+				}
+			}
+
+		case "catalog":
+			if len(args) > 3 {
+				fmt.Printf("usage: catalog [archive_id [device]]\n")
+				break
+			}
+			catalogList(arg1, arg2)
+
+		case "rotatekeys":
+			err := atRestRotate()
+			if err != nil {
+				fmt.Printf("rotatekeys: %s\n", err)
+			}
+
 		default:
 			fmt.Printf("Unrecognized: '%s'\n", message)
 
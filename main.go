@@ -4,9 +4,53 @@
 
 package main
 
+import (
+	"fmt"
+	"os"
+)
+
 // Main service entry point
 func main() {
 
+	// Decrypt an archive offline, without starting the service
+	if len(os.Args) > 1 && os.Args[1] == "decrypt" {
+		if len(os.Args) < 4 || len(os.Args) > 5 {
+			fmt.Printf("usage: %s decrypt <private-key.pem> <archive.enc> [output]\n", os.Args[0])
+			os.Exit(2)
+		}
+		outPath := ""
+		if len(os.Args) == 5 {
+			outPath = os.Args[4]
+		}
+		err := decryptArchive(os.Args[2], os.Args[3], outPath)
+		if err != nil {
+			fmt.Printf("decrypt: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Load the server-side route config store
+	routeStoreInit()
+
+	// Load the master key used to encrypt data at rest, refusing to run without it if one
+	// has been configured so that nothing is ever written in cleartext by mistake
+	err := atRestInit()
+	if err != nil {
+		fmt.Printf("encryption: %s\n", err)
+		os.Exit(1)
+	}
+
+	// Open the catalog in which uploaded archives are recorded
+	err = catalogInit()
+	if err != nil {
+		fmt.Printf("catalog: %s\n", err)
+		os.Exit(1)
+	}
+
+	// Recover the spool of incoming events before anything is appended to it
+	spoolInit()
+
 	// Init our archive task, which periodically files requests into folders.
 	// Note that this must be initialized before HTTP handlers because of
 	// event queue.
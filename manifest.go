@@ -0,0 +1,210 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Checksums and manifests, so that archives may be audited without downloading them.  The
+// SHA-256 of each archive, along with a hash of the UIDs of the events within it, is computed
+// as the archive is staged and stored as metadata of the uploaded object.  Each archive is
+// also described by its own object in the _manifest directory of its folder, so that listing
+// that directory lists every archive that has been uploaded to the folder.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/blues/note-go/note"
+)
+
+// Suffix of the file, alongside a staged archive, describing its contents
+const stagedInfoSuffix = ".info"
+
+// Name of the directory, within each folder, holding the manifest object of each archive.
+// The leading underscore causes it to be ignored by query engines such as Athena that treat
+// the folder as a table.
+const manifestDirName = "_manifest"
+
+// Delay before retrying manifest updates that have failed
+const manifestRetryDelay = time.Duration(1) * time.Minute
+
+// Name of the file, within an archive's data directory, listing uploaded archives that have
+// yet to be added to their folders' manifests because updating a manifest failed
+const instancePendingManifestsFile = "manifests.json"
+
+// Metadata keys of uploaded archives
+const manifestMetadataSHA256 = "sha256"
+const manifestMetadataEvents = "events"
+const manifestMetadataEventUIDs = "event-uids-sha256"
+
+// Description of the contents of a staged archive, computed as it is staged, where First and
+// Last are the times in microseconds of the first and last events encoded in it
+type stagedInfo struct {
+	SHA256          string   `json:"sha256"`
+	Events          int      `json:"events"`
+	First           int64    `json:"first"`
+	Last            int64    `json:"last"`
+	EventUIDsSHA256 string   `json:"event_uids_sha256"`
+	Devices         []string `json:"devices,omitempty"`
+}
+
+// An archive described by a manifest object, where First and Last are the times in
+// microseconds of its first and last events according to the route's time_basis, and
+// Archived is the time of the upload in seconds
+type manifestObject struct {
+	Key             string `json:"key"`
+	Size            int64  `json:"size"`
+	SHA256          string `json:"sha256"`
+	Events          int    `json:"events"`
+	First           int64  `json:"first"`
+	Last            int64  `json:"last"`
+	EventUIDsSHA256 string `json:"event_uids_sha256"`
+	Archived        int64  `json:"archived"`
+}
+
+// Hash the UIDs of a set of events, in a way that doesn't depend upon their order, by taking
+// the SHA-256 of the sorted UIDs each followed by a newline
+func hashEventUIDs(uids []string) string {
+	sorted := append([]string{}, uids...)
+	sort.Strings(sorted)
+	hash := sha256.New()
+	for _, uid := range sorted {
+		hash.Write([]byte(uid + "\n"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Read the description of a staged archive
+func readStagedInfo(stagedPath string) (info stagedInfo, err error) {
+	infoJSON, err := os.ReadFile(stagedPath + stagedInfoSuffix)
+	if err == nil {
+		err = note.JSONUnmarshal(infoJSON, &info)
+	}
+	return info, err
+}
+
+// Write the description of a staged archive
+func writeStagedInfo(stagedPath string, info stagedInfo) (err error) {
+	infoJSON, err := note.JSONMarshal(info)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(stagedPath+stagedInfoSuffix, infoJSON)
+}
+
+// Metadata stored with an uploaded archive
+func (info stagedInfo) metadata() map[string]string {
+	return map[string]string{
+		manifestMetadataSHA256:    info.SHA256,
+		manifestMetadataEvents:    fmt.Sprintf("%d", info.Events),
+		manifestMetadataEventUIDs: info.EventUIDsSHA256,
+	}
+}
+
+// Key of the manifest object describing the specified archive
+func manifestKey(objectKey string) string {
+	return path.Join(path.Dir(objectKey), manifestDirName, path.Base(objectKey)+".json")
+}
+
+// Write the manifest object of an uploaded archive, replacing that of any earlier upload of
+// the same key.  Because each archive has its own manifest object, which is written without
+// reading any other, the cost of an upload doesn't grow with the number of archives in its
+// folder, and archives that share a bucket and folder never overwrite each other's listings.
+func updateManifest(ctx context.Context, rc RouteConfig, sink Sink, object manifestObject) (err error) {
+
+	key := manifestKey(object.Key)
+	manifestJSON, err := note.JSONMarshalIndent(object, "", "  ")
+	if err != nil {
+		return err
+	}
+	opts := SinkPutOptions{}
+	opts.ContentType = "application/json"
+	opts.ACL = s3ObjectACL(rc)
+	err = sink.PutObject(ctx, key, bytes.NewReader(manifestJSON), int64(len(manifestJSON)), opts)
+	if err != nil {
+		return fmt.Errorf("can't write manifest %s: %s", key, err)
+	}
+	return nil
+
+}
+
+// Add uploaded archives to their folders' manifests, along with any archives that previously
+// failed to be added, recording those that fail again so that they are retried later.  The
+// first error encountered is returned.
+func updateManifests(ctx context.Context, rc RouteConfig, sink Sink, objects []manifestObject) (err error) {
+	pending, err := readPendingManifests(rc.ArchiveID)
+	objects = append(pending, objects...)
+	failed := []manifestObject{}
+	for _, object := range objects {
+		objectErr := updateManifest(ctx, rc, sink, object)
+		if objectErr != nil {
+			failed = append(failed, object)
+			if err == nil {
+				err = objectErr
+			}
+		}
+	}
+	writeErr := writePendingManifests(rc.ArchiveID, failed)
+	if err == nil {
+		err = writeErr
+	}
+	return err
+}
+
+// Retry adding archives to their folders' manifests, if any previously failed to be added
+func retryPendingManifests(rc RouteConfig) (err error) {
+	pending, err := readPendingManifests(rc.ArchiveID)
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(rc.UploadTimeoutMins)*time.Minute)
+	defer cancel()
+	sink, err := newSink(ctx, rc)
+	if err != nil {
+		return err
+	}
+	return updateManifests(ctx, rc, sink, nil)
+}
+
+// Read the list of archives that have yet to be added to their folders' manifests
+func readPendingManifests(archiveID string) (objects []manifestObject, err error) {
+	objectsJSON, err := os.ReadFile(configDataPath(archiveID) + instancePendingManifestsFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err == nil {
+		err = note.JSONUnmarshal(objectsJSON, &objects)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read pending manifest updates: %s", err)
+	}
+	return objects, nil
+}
+
+// Write the list of archives that have yet to be added to their folders' manifests, removing
+// it if there are none
+func writePendingManifests(archiveID string, objects []manifestObject) (err error) {
+	filePath := configDataPath(archiveID) + instancePendingManifestsFile
+	if len(objects) == 0 {
+		err = os.Remove(filePath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	objectsJSON, err := note.JSONMarshal(objects)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(filePath, objectsJSON)
+	if err != nil {
+		return fmt.Errorf("can't record pending manifest updates: %s", err)
+	}
+	return nil
+}
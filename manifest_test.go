@@ -0,0 +1,204 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/blues/note-go/note"
+)
+
+func TestHashEventUIDs(t *testing.T) {
+
+	// The hash is of the sorted UIDs, each followed by a newline, so doesn't depend on order
+	expected := sha256.Sum256([]byte("a\nb\nc\n"))
+	hash := hashEventUIDs([]string{"c", "a", "b"})
+	if hash != hex.EncodeToString(expected[:]) {
+		t.Errorf("expected %x, got %s", expected, hash)
+	}
+	if hashEventUIDs([]string{"b", "c", "a"}) != hash {
+		t.Errorf("expected hash not to depend on order")
+	}
+	if hashEventUIDs([]string{"a", "b"}) == hash {
+		t.Errorf("expected hash to depend on UIDs")
+	}
+
+	// The UIDs supplied must not be reordered
+	uids := []string{"b", "a"}
+	hashEventUIDs(uids)
+	if uids[0] != "b" {
+		t.Errorf("expected UIDs not to be sorted in place")
+	}
+
+}
+
+// Read the manifest objects of a folder's archives from a sink
+func readTestManifest(t *testing.T, sink Sink, folder string) (objects []manifestObject) {
+	listed, err := sink.ListObjects(context.Background(), path.Join(folder, manifestDirName)+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, manifest := range listed {
+		manifestJSON, exists, err := sink.GetObject(context.Background(), manifest.Key)
+		if err != nil || !exists {
+			t.Fatalf("can't read manifest %s: %v", manifest.Key, err)
+		}
+		var object manifestObject
+		err = note.JSONUnmarshal(manifestJSON, &object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if manifestKey(object.Key) != manifest.Key {
+			t.Errorf("expected manifest of %s to be %s, got %s", object.Key, manifestKey(object.Key), manifest.Key)
+		}
+		objects = append(objects, object)
+	}
+	return objects
+}
+
+func TestUpdateManifest(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	rc := RouteConfig{ArchiveID: "test", SinkType: sinkTypeFile, BucketName: "test"}
+	sink, err := newFileSink(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// Each archive has its own manifest object, which is replaced by a later upload of the
+	// same key, and which is written without reading those of other archives
+	updates := []manifestObject{
+		{Key: "a/b/300-400-2.ndjson", Events: 2},
+		{Key: "a/b/100-200-1.ndjson", Events: 1},
+		{Key: "a/c/100-200-1.ndjson", Events: 1},
+		{Key: "a/b/300-400-2.ndjson", Events: 3},
+	}
+	for _, object := range updates {
+		err = updateManifest(ctx, rc, sink, object)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	objects := readTestManifest(t, sink, "a/b")
+	if len(objects) != 2 {
+		t.Fatalf("expected 2 objects, got %+v", objects)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	if objects[0].Key != "a/b/100-200-1.ndjson" || objects[1].Key != "a/b/300-400-2.ndjson" {
+		t.Errorf("unexpected objects %+v", objects)
+	}
+	if objects[1].Events != 3 {
+		t.Errorf("expected replaced object to have 3 events, got %d", objects[1].Events)
+	}
+	objects = readTestManifest(t, sink, "a/c")
+	if len(objects) != 1 {
+		t.Errorf("expected 1 object in a/c, got %+v", objects)
+	}
+	counting := &countingSink{fileSink: sink}
+	err = updateManifest(ctx, rc, counting, manifestObject{Key: "a/b/500-600-1.ndjson"})
+	if err != nil || counting.gets != 0 {
+		t.Errorf("expected manifest to be written without reading, got %d reads (%v)", counting.gets, err)
+	}
+
+}
+
+// File sink whose manifests can't be written
+type failingManifestSink struct {
+	*fileSink
+	failing bool
+}
+
+func (sink *failingManifestSink) PutObject(ctx context.Context, key string, body io.ReaderAt, size int64, opts SinkPutOptions) (err error) {
+	if sink.failing && path.Base(path.Dir(key)) == manifestDirName {
+		return fmt.Errorf("manifest writes are failing")
+	}
+	return sink.fileSink.PutObject(ctx, key, body, size, opts)
+}
+
+func TestUpdateManifestsRetriesPending(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	rc := RouteConfig{ArchiveID: "test", SinkType: sinkTypeFile, BucketName: "test"}
+	os.MkdirAll(configDataPath(rc.ArchiveID), 0777)
+	fileSink, err := newFileSink(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &failingManifestSink{fileSink: fileSink, failing: true}
+	ctx := context.Background()
+
+	// Archives whose manifest updates fail are recorded
+	err = updateManifests(ctx, rc, sink, []manifestObject{{Key: "a/100-200-1.ndjson"}})
+	if err == nil {
+		t.Fatal("expected manifest update to fail")
+	}
+	err = updateManifests(ctx, rc, sink, []manifestObject{{Key: "b/100-200-1.ndjson"}})
+	if err == nil {
+		t.Fatal("expected manifest update to fail")
+	}
+	pending, err := readPendingManifests(rc.ArchiveID)
+	if err != nil || len(pending) != 2 {
+		t.Fatalf("expected 2 pending manifest updates, got %+v (%v)", pending, err)
+	}
+
+	// Once manifests can be written, the pending archives are listed along with the new one
+	sink.failing = false
+	err = updateManifests(ctx, rc, sink, []manifestObject{{Key: "a/300-400-1.ndjson"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objects := readTestManifest(t, sink, "a"); len(objects) != 2 {
+		t.Errorf("expected 2 objects in a, got %+v", objects)
+	}
+	if objects := readTestManifest(t, sink, "b"); len(objects) != 1 {
+		t.Errorf("expected 1 object in b, got %+v", objects)
+	}
+	pending, err = readPendingManifests(rc.ArchiveID)
+	if err != nil || len(pending) != 0 {
+		t.Errorf("expected no pending manifest updates, got %+v (%v)", pending, err)
+	}
+	_, err = os.Stat(configDataPath(rc.ArchiveID) + instancePendingManifestsFile)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected pending manifest updates file to be removed")
+	}
+
+}
+
+func TestPerformArchiveRetriesPendingManifests(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	spoolFolders = map[spoolFolderKey]*spoolFolder{}
+	spoolLoaded = map[string]bool{}
+	rc := RouteConfig{ArchiveID: "test", SinkType: sinkTypeFile, BucketName: "test", UploadTimeoutMins: 1}
+	err := writeRouteConfig(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An archive whose manifest still can't be written causes the archive to be processed
+	// again shortly, even though it has no events spooled
+	err = writePendingManifests(rc.ArchiveID, []manifestObject{{Key: "../escape.ndjson"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	nextDue := performArchive(rc.ArchiveID)
+	if nextDue.Before(now.Add(manifestRetryDelay)) || nextDue.After(time.Now().Add(manifestRetryDelay)) {
+		t.Errorf("expected next due in %s, got %s", manifestRetryDelay, nextDue)
+	}
+	pending, _ := readPendingManifests(rc.ArchiveID)
+	if len(pending) != 1 {
+		t.Errorf("expected manifest update to remain pending, got %+v", pending)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Hive-style partitioning of folders, so that query engines such as Athena and Trino can prune
+// the folders that they read.  The leading folders of the file_folder template, which may only
+// contain [id], are the location of the table, and every other token becomes a folder named
+// for the token followed by an equals sign and its value, such as year=2022/month=07.
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/blues/note-go/note"
+)
+
+// Partitioning modes that may be specified in a route's file_partition
+const filePartitionNone = "none"
+const filePartitionHive = "hive"
+
+// Characters that may separate the tokens of a partitioned folder, which are dropped because
+// each token becomes a folder of its own
+const hivePartitionSeparators = "-_."
+
+// Validate a partitioning mode
+func validFilePartition(filePartition string) (err error) {
+	switch filePartition {
+	case filePartitionNone, filePartitionHive:
+		return nil
+	}
+	return fmt.Errorf("file_partition must be none or hive")
+}
+
+// Split a folder template into the location of the table and the names of its partitions,
+// in the order in which they appear.  Folders after the location may contain only tokens and
+// the separators between them, such as [year]-[month].
+func parseHivePartitions(template string) (location string, partitions []string, err error) {
+	locationFolders := []string{}
+	for _, folder := range strings.Split(template, "/") {
+		remaining := strings.ReplaceAll(folder, "[id]", "")
+		if len(partitions) == 0 && !strings.Contains(remaining, "[") {
+			locationFolders = append(locationFolders, folder)
+			continue
+		}
+		for {
+			start := strings.Index(folder, "[")
+			if start == -1 {
+				break
+			}
+			end := strings.Index(folder, "]")
+			if strings.Trim(folder[:start], hivePartitionSeparators) != "" {
+				return "", nil, fmt.Errorf("file_partition hive requires that folders after the table location contain only tokens")
+			}
+			name := folder[start+1 : end]
+			for _, partition := range partitions {
+				if partition == name {
+					return "", nil, fmt.Errorf("file_partition hive requires that file_folder contain %s only once", folder[start:end+1])
+				}
+			}
+			partitions = append(partitions, name)
+			folder = folder[end+1:]
+		}
+		if strings.Trim(folder, hivePartitionSeparators) != "" {
+			return "", nil, fmt.Errorf("file_partition hive requires that folders after the table location contain only tokens")
+		}
+	}
+	if len(partitions) == 0 {
+		return "", nil, fmt.Errorf("file_partition hive requires that file_folder contain a token other than [id]")
+	}
+	return strings.Join(locationFolders, "/"), partitions, nil
+}
+
+// Escape a partition value in the way that Hive does, so that characters that aren't allowed
+// in a bucket key are restored when the partitions are loaded, such as a device UID of
+// dev:864475044204278 becoming dev%3A864475044204278
+func hivePartitionValue(value string) string {
+	escaped := ""
+	for _, ch := range []byte(value) {
+		if (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '!' || ch == '(' || ch == ')' {
+			escaped += string(ch)
+		} else {
+			escaped += fmt.Sprintf("%%%02X", ch)
+		}
+	}
+	return escaped
+}
+
+// Expand a partitioned folder template for an event, cleaning the location and escaping each
+// value separately so that the equals signs naming the partitions are kept
+func expandHiveFolderTemplate(template string, archiveID string, event note.Event, eventJSON []byte, t time.Time) (folder string) {
+	location, partitions, _ := parseHivePartitions(template)
+	values := folderTokenValues(archiveID, event, eventJSON, t)
+	folders := []string{}
+	if location != "" {
+		folders = append(folders, cleanKey(substituteFolderTokens(location, values)))
+	}
+	for _, name := range partitions {
+		folders = append(folders, name+"="+hivePartitionValue(values["["+name+"]"]))
+	}
+	return strings.Join(folders, "/")
+}
@@ -0,0 +1,107 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Per-folder retry state, so that a folder whose upload fails is retried with exponential
+// backoff and jitter rather than on every pass of the archiver, and is moved to the dead
+// letter directory once it has failed too many times.  The state of each archive's folders
+// is kept in a retry.json file in its data directory.
+package main
+
+import (
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/blues/note-go/note"
+)
+
+// Name of the retry state file within an archive's data directory
+const instanceRetryFile = "retry.json"
+
+// Delay before the first retry of a failed upload, which doubles with each failure up to the maximum
+const retryBaseDelay = time.Duration(1) * time.Minute
+const retryMaxDelay = time.Duration(6) * time.Hour
+
+// Retry state of a folder whose upload has failed
+type folderRetry struct {
+	Attempts    int    `json:"attempts"`
+	NextAttempt int64  `json:"next_attempt"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
+// Read the retry state of all of an archive's folders
+func readRetryState(archiveID string) (state map[string]folderRetry) {
+	state = map[string]folderRetry{}
+	stateJSON, err := os.ReadFile(configDataPath(archiveID) + instanceRetryFile)
+	if err == nil {
+		note.JSONUnmarshal(stateJSON, &state)
+	}
+	return state
+}
+
+// Write the retry state of all of an archive's folders, removing the file if none are failing
+func writeRetryState(archiveID string, state map[string]folderRetry) (err error) {
+	filePath := configDataPath(archiveID) + instanceRetryFile
+	if len(state) == 0 {
+		err = os.Remove(filePath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	stateJSON, err := note.JSONMarshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filePath, stateJSON)
+}
+
+// Get the time before which a folder should not be retried, which is zero if it isn't failing
+func folderRetryAfter(archiveID string, folder string) time.Time {
+	retry, present := readRetryState(archiveID)[folder]
+	if !present {
+		return time.Time{}
+	}
+	return time.Unix(retry.NextAttempt, 0)
+}
+
+// Delay before retrying a folder that has failed the specified number of attempts, before
+// jitter is applied.  The delay is doubled only until it reaches the maximum, rather than
+// shifted by the number of attempts, which would overflow after enough of them.
+func retryDelay(attempts int) (delay time.Duration) {
+	delay = retryBaseDelay
+	for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay
+}
+
+// Record a failed upload of a folder, scheduling its next attempt, and returning the number
+// of attempts that have now failed
+func folderUploadFailed(archiveID string, folder string, uploadErr error) (attempts int, nextAttempt time.Time) {
+	state := readRetryState(archiveID)
+	retry := state[folder]
+	retry.Attempts++
+	delay := retryDelay(retry.Attempts)
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+	nextAttempt = time.Now().Add(delay)
+	retry.NextAttempt = nextAttempt.Unix()
+	retry.LastError = uploadErr.Error()
+	state[folder] = retry
+	writeRetryState(archiveID, state)
+	return retry.Attempts, nextAttempt
+}
+
+// Forget the retry state of a folder, because its upload succeeded or it was abandoned
+func folderRetryClear(archiveID string, folder string) {
+	state := readRetryState(archiveID)
+	_, present := state[folder]
+	if present {
+		delete(state, folder)
+		writeRetryState(archiveID, state)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, retryMaxDelay},
+		{29, retryMaxDelay},
+		{64, retryMaxDelay},
+		{1000, retryMaxDelay},
+	}
+	for _, test := range tests {
+		delay := retryDelay(test.attempts)
+		if delay != test.delay {
+			t.Errorf("%d attempts: expected %s, got %s", test.attempts, test.delay, delay)
+		}
+	}
+}
+
+func TestFolderUploadFailedManyAttempts(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	os.MkdirAll(configDataPath("test"), 0777)
+
+	// However many attempts have failed, the next is scheduled no later than the maximum delay
+	err := writeRetryState("test", map[string]folderRetry{"a": {Attempts: 999}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		attempts, nextAttempt := folderUploadFailed("test", "a", fmt.Errorf("upload failed"))
+		if attempts != 1000+i {
+			t.Errorf("expected %d attempts, got %d", 1000+i, attempts)
+		}
+		if nextAttempt.Before(time.Now().Add(retryMaxDelay/2-time.Second)) || nextAttempt.After(time.Now().Add(retryMaxDelay)) {
+			t.Errorf("expected next attempt within the maximum delay, got %s", nextAttempt)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Server-side store of route configs, so that archives may be defined once on the server
+// rather than having settings and credentials sent in the HTTP headers of every event.
+// The store is a JSON file of the form:
+//
+//	{
+//	  "stored_only": false,
+//	  "archives": {
+//	    "airnote": {
+//	      "archive_secret": "a-long-random-token",
+//	      "header_overrides": ["archive_every_mins"],
+//	      "config": {
+//	        "bucket_name": "my-event-archive",
+//	        "bucket_region": "us-east-1",
+//	        "file_access": "private",
+//	        "key_id": "AKIA...",
+//	        "key_secret": "...",
+//	        "archive_every_mins": 60
+//	      }
+//	    }
+//	  }
+//	}
+//
+// where each archive's config uses the same field names as the HTTP headers.  It is loaded at
+// startup and reloaded whenever it changes.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/blues/note-go/note"
+)
+
+// Environment variable that may be used to override the location of the store
+const routeStoreEnv = "ARCHIVE_CONFIG"
+
+// Default location of the store, relative to the home directory
+const routeStoreFile = "/archives.json"
+
+// How often to check the store for changes
+const routeStorePollPeriod = time.Duration(15) * time.Second
+
+// An archive defined in the store
+type storedArchive struct {
+	ArchiveSecret   string                 `json:"archive_secret,omitempty"`
+	HeaderOverrides []string               `json:"header_overrides,omitempty"`
+	Config          map[string]interface{} `json:"config,omitempty"`
+}
+
+// Contents of the store.  If StoredOnly is set, only archives defined in the store are accepted.
+type routeStoreContents struct {
+	StoredOnly bool                     `json:"stored_only,omitempty"`
+	Archives   map[string]storedArchive `json:"archives,omitempty"`
+}
+
+// The currently-loaded store
+var routeStoreLock sync.RWMutex
+var routeStore routeStoreContents
+var routeStoreModified time.Time
+
+// Get the path of the store
+func routeStorePath() string {
+	path := os.Getenv(routeStoreEnv)
+	if path == "" {
+		homedir, _ := os.UserHomeDir()
+		path = homedir + routeStoreFile
+	}
+	return path
+}
+
+// Load the store, and watch it for changes
+func routeStoreInit() {
+	routeStoreLoad()
+	go routeStoreWatcher()
+}
+
+// Reload the store whenever its modification time changes
+func routeStoreWatcher() {
+	for {
+		time.Sleep(routeStorePollPeriod)
+		info, err := os.Stat(routeStorePath())
+		routeStoreLock.RLock()
+		modified := routeStoreModified
+		routeStoreLock.RUnlock()
+		if err == nil && !info.ModTime().Equal(modified) || err != nil && !modified.IsZero() {
+			routeStoreLoad()
+		}
+	}
+}
+
+// Load the store, validating every archive within it.  If the store is invalid, the
+// previously-loaded store remains in effect.
+func routeStoreLoad() (err error) {
+	path := routeStorePath()
+	var contents routeStoreContents
+	var modified time.Time
+	info, err := os.Stat(path)
+	if err == nil {
+		modified = info.ModTime()
+		var storeJSON []byte
+		storeJSON, err = os.ReadFile(path)
+		if err == nil {
+			err = note.JSONUnmarshal(storeJSON, &contents)
+		}
+		for archiveID, archive := range contents.Archives {
+			if err != nil {
+				break
+			}
+			err = validArchiveID(archiveID)
+			if err == nil {
+				_, err = storedRouteConfig(archiveID, archive, nil)
+			}
+			if err != nil {
+				err = fmt.Errorf("archive %s: %s", archiveID, err)
+			}
+		}
+		if err != nil {
+			fmt.Printf("config: error loading %s, keeping previous configuration: %s\n", path, err)
+			routeStoreLock.Lock()
+			routeStoreModified = modified
+			routeStoreLock.Unlock()
+			return err
+		}
+		fmt.Printf("config: loaded %d archives from %s\n", len(contents.Archives), path)
+	} else if !os.IsNotExist(err) {
+		fmt.Printf("config: can't read %s: %s\n", path, err)
+		return err
+	}
+	routeStoreLock.Lock()
+	routeStore = contents
+	routeStoreModified = modified
+	routeStoreLock.Unlock()
+	return nil
+}
+
+// Look up an archive in the store, also returning whether only stored archives are accepted
+func storedArchiveConfig(archiveID string) (archive storedArchive, exists bool, storedOnly bool) {
+	routeStoreLock.RLock()
+	defer routeStoreLock.RUnlock()
+	archive, exists = routeStore.Archives[archiveID]
+	return archive, exists, routeStore.StoredOnly
+}
+
+// Name of the file, within a stored archive's data directory, holding the header fields with
+// which the most recent event overrode the archive's stored config, so that the archive is
+// uploaded using the same config.  The archive's stored config itself is never written to
+// its data directory, so that changes to the store take effect without waiting for an event.
+const instanceOverridesFile = "overrides.json"
+
+// Gather the header fields of a request that a stored archive permits to override its config
+func storedOverrides(r *http.Request, archive storedArchive) (overrides map[string]string) {
+	overrides = map[string]string{}
+	for _, fieldName := range archive.HeaderOverrides {
+		value, exists := headerField(r, fieldName)
+		if exists {
+			overrides[fieldName] = value
+		}
+	}
+	return overrides
+}
+
+// Generate the route config for a stored archive, applying those of the specified overrides
+// that the archive permits to override its stored config
+func storedRouteConfig(archiveID string, archive storedArchive, overrides map[string]string) (rc RouteConfig, err error) {
+	rc, err = parseRouteConfig(func(fieldName string) (string, bool) {
+		if fieldName == "archive_id" {
+			return archiveID, true
+		}
+		for _, override := range archive.HeaderOverrides {
+			if override == fieldName {
+				value, exists := overrides[fieldName]
+				if exists {
+					return value, true
+				}
+			}
+		}
+		value, present := archive.Config[fieldName]
+		if !present || value == nil {
+			return "", false
+		}
+		s := fmt.Sprint(value)
+		return s, s != ""
+	})
+	rc.ArchiveSecret = archive.ArchiveSecret
+	return rc, err
+}
+
+// Read the overrides most recently applied to a stored archive, decrypting them because they
+// may include credentials
+func readStoredOverrides(archiveID string) (overrides map[string]string, err error) {
+	overrides = map[string]string{}
+	overridesJSON, err := os.ReadFile(configDataPath(archiveID) + instanceOverridesFile)
+	if os.IsNotExist(err) {
+		return overrides, nil
+	}
+	if err == nil {
+		err = note.JSONUnmarshal(overridesJSON, &overrides)
+	}
+	if err != nil {
+		return overrides, err
+	}
+	for fieldName, value := range overrides {
+		overrides[fieldName], err = atRestOpenString(archiveID, value)
+		if err != nil {
+			return overrides, fmt.Errorf("%s: %s", fieldName, err)
+		}
+	}
+	return overrides, nil
+}
+
+// Atomically write the overrides applied to a stored archive, encrypting them
+func writeStoredOverrides(archiveID string, overrides map[string]string) (err error) {
+	sealed := map[string]string{}
+	for fieldName, value := range overrides {
+		sealed[fieldName], err = atRestSealString(archiveID, value)
+		if err != nil {
+			return err
+		}
+	}
+	overridesJSON, err := note.JSONMarshal(sealed)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(configDataPath(archiveID)+instanceOverridesFile, overridesJSON)
+}
+
+// Get the route config with which an archive is uploaded.  That of an archive defined in the
+// store comes from the currently-loaded store, and that of any other archive from the config
+// saved when it last received an event.
+func archiveRouteConfig(archiveID string) (rc RouteConfig, err error) {
+	archive, isStored, _ := storedArchiveConfig(archiveID)
+	if !isStored {
+		return readRouteConfig(archiveID)
+	}
+	overrides, err := readStoredOverrides(archiveID)
+	if err != nil {
+		return rc, fmt.Errorf("can't read overrides: %s", err)
+	}
+	return storedRouteConfig(archiveID, archive, overrides)
+}
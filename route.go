@@ -0,0 +1,485 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Parsing and validation of the route configuration supplied in HTTP headers
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/blues/note-go/note"
+)
+
+// Maximum count of events per archive file.  Because archives are encoded into
+// a staging file before they are uploaded, this is bounded by local disk rather
+// than by memory.
+const maxArchiveCountExceeds = 100000
+
+// Defaults for optional configuration fields
+const defaultArchiveEveryMins = 1440
+const defaultArchiveCountExceeds = 1000
+const defaultFileFormat = "array"
+const defaultFileFolder = "[id]/[year]-[month]"
+const defaultUploadPartMB = 16
+const defaultUploadMaxAttempts = 10
+const defaultUploadTimeoutMins = 60
+
+// Configuration object
+type RouteConfig struct {
+	ArchiveID           string `json:"archive_id"`
+	ArchiveCountExceeds int    `json:"archive_count_exceeds"`
+	ArchiveEveryMins    int    `json:"archive_every_mins"`
+	BucketEndpoint      string `json:"bucket_endpoint"`
+	BucketName          string `json:"bucket_name"`
+	BucketRegion        string `json:"bucket_region"`
+	FileAccess          string `json:"file_access"`
+	FileCompression     string `json:"file_compression"`
+	FileFormat          string `json:"file_format"`
+	FileFolder          string `json:"file_folder"`
+	FilePartition       string `json:"file_partition,omitempty"`
+	FileTable           string `json:"file_table,omitempty"`
+	FilePublicKey       string `json:"file_public_key,omitempty"`
+	FileSchema          string `json:"file_schema,omitempty"`
+	FileColumns         string `json:"file_columns,omitempty"`
+	FileMissing         string `json:"file_missing,omitempty"`
+	FileFormulas        string `json:"file_formulas,omitempty"`
+	FileStorageClass    string `json:"file_storage_class"`
+	KeyID               string `json:"key_id"`
+	KeySecret           string `json:"key_secret"`
+	SinkType            string `json:"sink_type"`
+	SSEMode             string `json:"sse_mode"`
+	SSEKMSKeyID         string `json:"sse_kms_key_id,omitempty"`
+	SSECustomerKey      string `json:"sse_customer_key,omitempty"`
+	TimeBasis           string `json:"time_basis,omitempty"`
+	TimeMissing         string `json:"time_missing,omitempty"`
+	UploadPartMB        int    `json:"upload_part_mb"`
+	UploadMaxAttempts   int    `json:"upload_max_attempts"`
+	UploadTimeoutMins   int    `json:"upload_timeout_mins"`
+	ArchiveSecret       string `json:"archive_secret,omitempty"`
+}
+
+// Read an archive's stored route config, decrypting its credentials
+func readRouteConfig(archiveID string) (rc RouteConfig, err error) {
+	rcJSON, err := os.ReadFile(configDataPath(archiveID) + instanceRouteConfigFile)
+	if err != nil {
+		return rc, err
+	}
+	err = note.JSONUnmarshal(rcJSON, &rc)
+	if err != nil {
+		return rc, err
+	}
+	// Fields added by later versions are missing from configs written by earlier versions
+	if rc.UploadMaxAttempts == 0 {
+		rc.UploadMaxAttempts = defaultUploadMaxAttempts
+	}
+	if rc.UploadTimeoutMins == 0 {
+		rc.UploadTimeoutMins = defaultUploadTimeoutMins
+	}
+	rc.KeySecret, err = atRestOpenString(archiveID, rc.KeySecret)
+	if err != nil {
+		return rc, fmt.Errorf("key_secret: %s", err)
+	}
+	rc.ArchiveSecret, err = atRestOpenString(archiveID, rc.ArchiveSecret)
+	if err != nil {
+		return rc, fmt.Errorf("archive_secret: %s", err)
+	}
+	rc.SSECustomerKey, err = atRestOpenString(archiveID, rc.SSECustomerKey)
+	if err != nil {
+		return rc, fmt.Errorf("sse_customer_key: %s", err)
+	}
+	return rc, nil
+}
+
+// Atomically write an archive's route config, encrypting its credentials
+func writeRouteConfig(rc RouteConfig) (err error) {
+	rc.KeySecret, err = atRestSealString(rc.ArchiveID, rc.KeySecret)
+	if err != nil {
+		return err
+	}
+	rc.ArchiveSecret, err = atRestSealString(rc.ArchiveID, rc.ArchiveSecret)
+	if err != nil {
+		return err
+	}
+	rc.SSECustomerKey, err = atRestSealString(rc.ArchiveID, rc.SSECustomerKey)
+	if err != nil {
+		return err
+	}
+	rcJSON, err := note.JSONMarshal(rc)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(configDataPath(rc.ArchiveID)+instanceRouteConfigFile, rcJSON)
+}
+
+// Source of route config fields, returning the value of the named field if it exists
+type routeFieldSource func(fieldName string) (value string, exists bool)
+
+// Parse the route configuration from the request's headers, which may only select the file
+// sink if the server's operator has enabled it
+func routeConfigFromRequest(r *http.Request) (rc RouteConfig, err error) {
+	rc, err = parseRouteConfig(func(fieldName string) (string, bool) {
+		return headerField(r, fieldName)
+	})
+	if err == nil && rc.SinkType == sinkTypeFile && !configFileSinkEnabled() {
+		return rc, fmt.Errorf("sink_type file is not enabled on this server")
+	}
+	return rc, err
+}
+
+// Parse the route configuration, validating all fields so that a misconfigured
+// route is reported immediately rather than when archiving
+func parseRouteConfig(field routeFieldSource) (rc RouteConfig, err error) {
+	var exists bool
+
+	rc.ArchiveID, exists = field("archive_id")
+	if !exists {
+		return rc, fmt.Errorf("archive_id not specified")
+	}
+	err = validArchiveID(rc.ArchiveID)
+	if err != nil {
+		return
+	}
+
+	rc.ArchiveEveryMins, err = fieldInt(field, "archive_every_mins", defaultArchiveEveryMins)
+	if err != nil {
+		return
+	}
+	if rc.ArchiveEveryMins > 10080 {
+		return rc, fmt.Errorf("maximum minutes per file is 10080 (1 week)")
+	}
+
+	rc.ArchiveCountExceeds, err = fieldInt(field, "archive_count_exceeds", defaultArchiveCountExceeds)
+	if err != nil {
+		return
+	}
+	if rc.ArchiveCountExceeds > maxArchiveCountExceeds {
+		return rc, fmt.Errorf("maximum count of events per file is %d", maxArchiveCountExceeds)
+	}
+
+	rc.SinkType, exists = field("sink_type")
+	if !exists {
+		rc.SinkType = sinkTypeS3
+	}
+	if rc.SinkType != sinkTypeS3 && rc.SinkType != sinkTypeFile {
+		return rc, fmt.Errorf("sink_type must be either s3 or file")
+	}
+
+	rc.UploadPartMB, err = fieldInt(field, "upload_part_mb", defaultUploadPartMB)
+	if err != nil {
+		return
+	}
+	if rc.UploadPartMB < 5 || rc.UploadPartMB > 5120 {
+		return rc, fmt.Errorf("upload part size must be between 5 and 5120 megabytes")
+	}
+
+	rc.UploadMaxAttempts, err = fieldInt(field, "upload_max_attempts", defaultUploadMaxAttempts)
+	if err != nil {
+		return
+	}
+	if rc.UploadMaxAttempts > 1000 {
+		return rc, fmt.Errorf("maximum upload attempts is 1000")
+	}
+
+	rc.UploadTimeoutMins, err = fieldInt(field, "upload_timeout_mins", defaultUploadTimeoutMins)
+	if err != nil {
+		return
+	}
+	if rc.UploadTimeoutMins > 1440 {
+		return rc, fmt.Errorf("maximum upload timeout is 1440 minutes (1 day)")
+	}
+
+	rc.BucketEndpoint, _ = field("bucket_endpoint")
+
+	rc.BucketName, exists = field("bucket_name")
+	if !exists {
+		return rc, fmt.Errorf("bucket_name not specified")
+	}
+	if rc.SinkType == sinkTypeFile {
+		err = validFileSinkBucket(rc.BucketName)
+		if err != nil {
+			return
+		}
+	}
+
+	rc.BucketRegion, exists = field("bucket_region")
+	if !exists && rc.SinkType == sinkTypeS3 {
+		return rc, fmt.Errorf("bucket_region not specified")
+	}
+
+	rc.FileAccess, exists = field("file_access")
+	if exists && !s3ValidACL(rc.FileAccess) {
+		return rc, fmt.Errorf("file_access must be one of: %s", strings.Join(s3ValidACLs(), ", "))
+	}
+
+	rc.FileStorageClass, exists = field("file_storage_class")
+	if exists && !s3ValidStorageClass(rc.FileStorageClass) {
+		return rc, fmt.Errorf("file_storage_class must be one of: %s", strings.Join(s3ValidStorageClasses(), ", "))
+	}
+
+	rc.SSEMode, exists = field("sse_mode")
+	if !exists {
+		rc.SSEMode = sseModeNone
+	}
+	if !s3ValidSSEMode(rc.SSEMode) {
+		return rc, fmt.Errorf("sse_mode must be none, sse-s3, sse-kms, or sse-c")
+	}
+	if rc.SSEMode != sseModeNone && rc.SinkType != sinkTypeS3 {
+		return rc, fmt.Errorf("sse_mode may only be used with sink_type s3")
+	}
+	rc.SSEKMSKeyID, exists = field("sse_kms_key_id")
+	if exists && rc.SSEMode != sseModeKMS {
+		return rc, fmt.Errorf("sse_kms_key_id may only be used with sse_mode sse-kms")
+	}
+	rc.SSECustomerKey, exists = field("sse_customer_key")
+	if exists && rc.SSEMode != sseModeCustomer {
+		return rc, fmt.Errorf("sse_customer_key may only be used with sse_mode sse-c")
+	}
+	if !exists && rc.SSEMode == sseModeCustomer {
+		return rc, fmt.Errorf("sse_customer_key not specified")
+	}
+	if exists {
+		_, err = parseSSECustomerKey(rc.SSECustomerKey)
+		if err != nil {
+			return
+		}
+	}
+
+	rc.FileFormat, exists = field("file_format")
+	if !exists {
+		rc.FileFormat = defaultFileFormat
+	}
+	err = validFileFormat(rc.FileFormat)
+	if err != nil {
+		return
+	}
+
+	rc.FileCompression, exists = field("file_compression")
+	if !exists {
+		rc.FileCompression = fileCompressionNone
+	}
+	err = validFileCompression(rc.FileFormat, rc.FileCompression)
+	if err != nil {
+		return
+	}
+
+	rc.FileSchema, exists = field("file_schema")
+	if exists {
+		if rc.FileFormat != fileFormatParquet {
+			return rc, fmt.Errorf("file_schema may only be used with file_format parquet")
+		}
+		_, err = parseParquetSchema(rc.FileSchema)
+		if err != nil {
+			return
+		}
+	}
+
+	rc.FileColumns, exists = field("file_columns")
+	if exists {
+		if rc.FileFormat != fileFormatCSV {
+			return rc, fmt.Errorf("file_columns may only be used with file_format csv")
+		}
+		_, err = parseCSVColumns(rc.FileColumns)
+		if err != nil {
+			return
+		}
+	}
+
+	rc.FileMissing, exists = field("file_missing")
+	if exists {
+		if rc.FileFormat != fileFormatCSV {
+			return rc, fmt.Errorf("file_missing may only be used with file_format csv")
+		}
+		err = validFileMissing(rc.FileMissing)
+		if err != nil {
+			return
+		}
+	}
+
+	rc.FileFormulas, exists = field("file_formulas")
+	if exists {
+		if rc.FileFormat != fileFormatCSV {
+			return rc, fmt.Errorf("file_formulas may only be used with file_format csv")
+		}
+		err = validFileFormulas(rc.FileFormulas)
+		if err != nil {
+			return
+		}
+	}
+
+	rc.FilePublicKey, exists = field("file_public_key")
+	if exists {
+		_, err = parseArchivePublicKey(rc.FilePublicKey)
+		if err != nil {
+			return
+		}
+	}
+
+	rc.FileFolder, exists = field("file_folder")
+	if !exists {
+		rc.FileFolder = defaultFileFolder
+	}
+	err = validFolderTemplate(rc.FileFolder)
+	if err != nil {
+		return
+	}
+
+	rc.FilePartition, exists = field("file_partition")
+	if !exists {
+		rc.FilePartition = filePartitionNone
+	}
+	err = validFilePartition(rc.FilePartition)
+	if err != nil {
+		return
+	}
+	if rc.FilePartition == filePartitionHive {
+		_, _, err = parseHivePartitions(rc.FileFolder)
+		if err != nil {
+			return
+		}
+	}
+
+	rc.FileTable, exists = field("file_table")
+	if exists {
+		if rc.FilePartition != filePartitionHive {
+			return rc, fmt.Errorf("file_table may only be used with file_partition hive")
+		}
+		if rc.FilePublicKey != "" {
+			return rc, fmt.Errorf("file_table may not be used with file_public_key, because encrypted files can't be queried")
+		}
+		err = validFileTable(rc.FileTable)
+		if err != nil {
+			return
+		}
+		_, err = tableDDL(rc)
+		if err != nil {
+			return
+		}
+	}
+
+	rc.TimeBasis, exists = field("time_basis")
+	if !exists {
+		rc.TimeBasis = timeBasisReceived
+	}
+	err = validTimeBasis(rc.TimeBasis)
+	if err != nil {
+		return
+	}
+
+	rc.TimeMissing, exists = field("time_missing")
+	if exists {
+		if rc.TimeBasis == timeBasisReceived {
+			return rc, fmt.Errorf("time_missing may only be used with time_basis when or routed")
+		}
+		err = validTimeMissing(rc.TimeMissing)
+		if err != nil {
+			return
+		}
+	}
+
+	rc.KeyID, exists = field("key_id")
+	if !exists && rc.SinkType == sinkTypeS3 {
+		return rc, fmt.Errorf("key_id not specified")
+	}
+	rc.KeySecret, exists = field("key_secret")
+	if !exists && rc.SinkType == sinkTypeS3 {
+		return rc, fmt.Errorf("key_secret not specified")
+	}
+
+	return rc, nil
+}
+
+// Get an optional positive integer field, using the default if it is not specified
+func fieldInt(field routeFieldSource, fieldName string, defaultValue int) (value int, err error) {
+	s, exists := field(fieldName)
+	if !exists {
+		return defaultValue, nil
+	}
+	value, err = strconv.Atoi(s)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%s must be a positive number", fieldName)
+	}
+	if value == 0 {
+		value = defaultValue
+	}
+	return value, nil
+}
+
+// Validate an archive ID, which is used as the name of a directory on the server
+func validArchiveID(archiveID string) (err error) {
+	if cleanKey(archiveID) != archiveID || strings.Contains(archiveID, "/") || strings.HasPrefix(archiveID, ".") {
+		return fmt.Errorf("archive_id may only contain letters, digits, and the characters - _ ! * ' ( )")
+	}
+	return nil
+}
+
+// Validate a file format
+func validFileFormat(fileFormat string) (err error) {
+	switch {
+	case fileFormat == "array" || fileFormat == "ndjson" || fileFormat == fileFormatParquet || fileFormat == fileFormatCSV || fileFormat == fileFormatAvro:
+		return nil
+	case strings.HasPrefix(fileFormat, "object:"):
+		if strings.TrimPrefix(fileFormat, "object:") == "" {
+			return fmt.Errorf("file_format object: must be followed by a field name")
+		}
+		return nil
+	}
+	return fmt.Errorf("file_format must be array, ndjson, parquet, csv, avro, or object:fieldname")
+}
+
+// Validate a file compression, which for Avro is the codec of its blocks
+func validFileCompression(fileFormat string, fileCompression string) (err error) {
+	if fileFormat == fileFormatAvro {
+		switch fileCompression {
+		case fileCompressionNone, fileCompressionDeflate, fileCompressionSnappy, fileCompressionZstd:
+			return nil
+		}
+		return fmt.Errorf("file_compression of avro must be none, deflate, snappy, or zstd")
+	}
+	switch fileCompression {
+	case fileCompressionNone, fileCompressionGzip, fileCompressionZstd:
+		return nil
+	}
+	return fmt.Errorf("file_compression must be none, gzip, or zstd")
+}
+
+// Validate a folder template, making sure that all of its tokens are known and that
+// it will produce a well-formed bucket key
+func validFolderTemplate(template string) (err error) {
+	if strings.Contains(template, " ") {
+		return fmt.Errorf("file_folder may not contain a space character")
+	}
+	if strings.HasPrefix(template, "/") || strings.HasSuffix(template, "/") {
+		return fmt.Errorf("file_folder may not begin or end with /")
+	}
+	for _, component := range strings.Split(template, "/") {
+		if component == "" || component == "." || component == ".." {
+			return fmt.Errorf("file_folder may not contain empty, . or .. folder names")
+		}
+	}
+	remaining := template
+	for {
+		start := strings.IndexAny(remaining, "[]")
+		if start == -1 {
+			break
+		}
+		if remaining[start] == ']' {
+			return fmt.Errorf("file_folder has a ] without a matching [")
+		}
+		end := strings.IndexAny(remaining[start+1:], "[]")
+		if end == -1 || remaining[start+1+end] == '[' {
+			return fmt.Errorf("file_folder has a [ without a matching ]")
+		}
+		end += start + 1
+		token := remaining[start : end+1]
+		if !folderTokenValid(token) {
+			return fmt.Errorf("file_folder contains unknown token %s", token)
+		}
+		remaining = remaining[end+1:]
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouteConfigFileSink(t *testing.T) {
+	request := func(bucketName string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("archive_id", "test")
+		r.Header.Set("sink_type", sinkTypeFile)
+		r.Header.Set("bucket_name", bucketName)
+		return r
+	}
+
+	// The file sink may only be selected through headers once the operator has enabled it
+	t.Setenv(fileSinkEnv, "")
+	_, err := routeConfigFromRequest(request("test"))
+	if err == nil {
+		t.Errorf("expected file sink to be refused unless enabled")
+	}
+	t.Setenv(fileSinkEnv, "true")
+	_, err = routeConfigFromRequest(request("test"))
+	if err != nil {
+		t.Errorf("expected file sink to be accepted once enabled, got %s", err)
+	}
+
+	// Bucket names that would escape the sink path are rejected when the route is received
+	for _, bucketName := range []string{"a/b", ".", "..", ".hidden"} {
+		_, err = routeConfigFromRequest(request(bucketName))
+		if err == nil {
+			t.Errorf("%s: expected bucket name to be rejected", bucketName)
+		}
+	}
+
+	// Archives in the config store may use the file sink regardless
+	t.Setenv(fileSinkEnv, "")
+	archive := storedArchive{Config: map[string]interface{}{"sink_type": sinkTypeFile, "bucket_name": "test"}}
+	_, err = storedRouteConfig("test", archive, nil)
+	if err != nil {
+		t.Errorf("expected stored archive to use the file sink, got %s", err)
+	}
+	archive.Config["bucket_name"] = "../test"
+	_, err = storedRouteConfig("test", archive, nil)
+	if err == nil {
+		t.Errorf("expected stored archive's bucket name to be validated")
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Sink that writes archives to the local file system, such as to an NFS mount
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// File sink state
+type fileSink struct {
+	root string
+}
+
+// Validate the name of a file sink's bucket, which names a directory within the sink path
+func validFileSinkBucket(bucketName string) (err error) {
+	if bucketName == "" || strings.Contains(bucketName, "/") || strings.HasPrefix(bucketName, ".") {
+		return fmt.Errorf("invalid bucket name for file sink: %s", bucketName)
+	}
+	return nil
+}
+
+// Create a file sink rooted in a directory named for the route's bucket
+func newFileSink(rc RouteConfig) (sink *fileSink, err error) {
+	err = validFileSinkBucket(rc.BucketName)
+	if err != nil {
+		return nil, err
+	}
+	sink = &fileSink{}
+	sink.root = configSinkPath(rc.BucketName)
+	return sink, nil
+}
+
+// Convert a key to a path within the sink, making sure that it can't escape the root
+func (sink *fileSink) keyPath(key string) (path string, err error) {
+	path = filepath.Join(sink.root, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, filepath.Clean(sink.root)+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid key for file sink: %s", key)
+	}
+	return path, nil
+}
+
+// PutObject writes an object to the file system in an atomic way.  Because the file system
+// has no place to store them, the options, including metadata, are ignored.
+func (sink *fileSink) PutObject(ctx context.Context, key string, body io.ReaderAt, size int64, opts SinkPutOptions) (err error) {
+	filePath, err := sink.keyPath(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(filePath), 0777)
+	if err != nil {
+		return fmt.Errorf("err creating folder: %s", err)
+	}
+	tempPath := filepath.Join(filepath.Dir(filePath), "."+uuid.New().String()+".temp")
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("err creating object: %s", err)
+	}
+	_, err = io.Copy(file, &contextReader{ctx, io.NewSectionReader(body, 0, size)})
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(tempPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("err writing object: %s", err)
+	}
+	return nil
+}
+
+// AbortObject does nothing, because an interrupted write leaves nothing behind but a temp file
+func (sink *fileSink) AbortObject(ctx context.Context, key string) (err error) {
+	return nil
+}
+
+// GetObject reads an object from the file system
+func (sink *fileSink) GetObject(ctx context.Context, key string) (body []byte, exists bool, err error) {
+	filePath, err := sink.keyPath(key)
+	if err != nil {
+		return nil, false, err
+	}
+	body, err = os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("err reading object: %s", err)
+	}
+	return body, true, nil
+}
+
+// HeadObject returns info about an object in the file system
+func (sink *fileSink) HeadObject(ctx context.Context, key string) (object SinkObject, exists bool, err error) {
+	filePath, err := sink.keyPath(key)
+	if err != nil {
+		return object, false, err
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return object, false, nil
+		}
+		return object, false, fmt.Errorf("err getting object info: %s", err)
+	}
+	object.Key = key
+	object.Size = info.Size()
+	object.Modified = info.ModTime()
+	return object, true, nil
+}
+
+// ListObjects lists the objects in the file system having the specified prefix
+func (sink *fileSink) ListObjects(ctx context.Context, prefix string) (objects []SinkObject, err error) {
+	err = filepath.Walk(sink.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		relPath, err := filepath.Rel(sink.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relPath)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		object := SinkObject{}
+		object.Key = key
+		object.Size = info.Size()
+		object.Modified = info.ModTime()
+		objects = append(objects, object)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("err listing objects: %s", err)
+	}
+	return objects, nil
+}
@@ -0,0 +1,445 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Sink that writes archives to an S3-compatible bucket
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/blues/note-go/note"
+)
+
+// Suffix of the files in which multipart upload progress is tracked
+const multipartStateSuffix = ".upload"
+
+// S3 limits that constrain multipart uploads
+const s3MinPartSize = 5 * 1024 * 1024
+const s3MaxParts = 10000
+
+// Server-side encryption modes that may be specified in a route's sse_mode
+const sseModeNone = "none"
+const sseModeS3 = "sse-s3"
+const sseModeKMS = "sse-kms"
+const sseModeCustomer = "sse-c"
+
+// S3 sink state
+type s3Sink struct {
+	client         *s3.S3
+	bucket         *string
+	partSize       int64
+	stateDir       string
+	sseMode        string
+	sseKMSKeyID    string
+	sseCustomerKey string
+}
+
+// Progress of a multipart upload, persisted so that an interrupted upload may be resumed
+type multipartState struct {
+	Key        string          `json:"key"`
+	UploadID   string          `json:"upload_id"`
+	Size       int64           `json:"size"`
+	PartSize   int64           `json:"part_size"`
+	Encryption string          `json:"encryption,omitempty"`
+	SHA256     string          `json:"sha256,omitempty"`
+	Parts      []multipartPart `json:"parts,omitempty"`
+}
+
+// Determine whether or not an interrupted upload may be resumed by an upload of the
+// specified object, which requires that the object have the same content and not merely the
+// same size, because staging the same events again doesn't produce the same bytes
+func (state multipartState) resumableBy(upload multipartState) bool {
+	return upload.SHA256 != "" && state.SHA256 == upload.SHA256 && state.Key == upload.Key && state.Size == upload.Size &&
+		state.PartSize == upload.PartSize && state.Encryption == upload.Encryption
+}
+
+// A part of a multipart upload that has been successfully uploaded
+type multipartPart struct {
+	Number int64  `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+// Create an S3 sink, creating the bucket if it doesn't already exist
+func newS3Sink(ctx context.Context, rc RouteConfig) (sink *s3Sink, err error) {
+	s3Config := &aws.Config{
+		Credentials:      credentials.NewStaticCredentials(rc.KeyID, rc.KeySecret, ""),
+		Endpoint:         aws.String(rc.BucketEndpoint),
+		Region:           aws.String(rc.BucketRegion),
+		S3ForcePathStyle: aws.Bool(true),
+	}
+	newSession, err := session.NewSession(s3Config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating session: %s", err)
+	}
+	sink = &s3Sink{}
+	sink.client = s3.New(newSession)
+	sink.bucket = aws.String(rc.BucketName)
+	sink.partSize = int64(rc.UploadPartMB) * 1024 * 1024
+	if sink.partSize < s3MinPartSize {
+		sink.partSize = s3MinPartSize
+	}
+	sink.stateDir = configDataPath(rc.ArchiveID + instanceUploads)
+	sink.sseMode = rc.SSEMode
+	sink.sseKMSKeyID = rc.SSEKMSKeyID
+	if rc.SSEMode == sseModeCustomer {
+		key, err := parseSSECustomerKey(rc.SSECustomerKey)
+		if err != nil {
+			return nil, err
+		}
+		sink.sseCustomerKey = string(key)
+	}
+	cparams := &s3.CreateBucketInput{
+		Bucket: sink.bucket,
+	}
+	sink.client.CreateBucketWithContext(ctx, cparams)
+	return sink, nil
+}
+
+// Canned ACLs that may be applied to objects
+func s3ValidACLs() []string {
+	return s3.ObjectCannedACL_Values()
+}
+
+// Canned ACL to be sent with a route's objects, which is none unless the route asks for one
+// other than "private".  Sending an ACL requires the s3:PutObjectAcl permission and fails on
+// buckets whose ACLs are disabled, as they are by default, whereas objects put without one
+// are private to the bucket's owner anyway.
+func s3ObjectACL(rc RouteConfig) string {
+	if rc.FileAccess == s3.ObjectCannedACLPrivate {
+		return ""
+	}
+	return rc.FileAccess
+}
+
+// Storage classes that objects may be placed into
+func s3ValidStorageClasses() []string {
+	return s3.StorageClass_Values()
+}
+
+// Determine whether or not an ACL is one of the canned ACLs
+func s3ValidACL(acl string) bool {
+	for _, value := range s3ValidACLs() {
+		if acl == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Determine whether or not a storage class is supported
+func s3ValidStorageClass(storageClass string) bool {
+	for _, value := range s3ValidStorageClasses() {
+		if storageClass == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Determine whether or not a server-side encryption mode is supported
+func s3ValidSSEMode(sseMode string) bool {
+	return sseMode == sseModeNone || sseMode == sseModeS3 || sseMode == sseModeKMS || sseMode == sseModeCustomer
+}
+
+// Parse a customer-provided encryption key, supplied as the base64 encoding of a 256-bit key
+func parseSSECustomerKey(customerKey string) (key []byte, err error) {
+	key, err = base64.StdEncoding.DecodeString(customerKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("sse_customer_key must be a base64-encoded 256-bit key")
+	}
+	return key, nil
+}
+
+// Server-side encryption to request of S3 when uploading, in the form used by the SDK
+func (sink *s3Sink) serverSideEncryption() (sse *string, kmsKeyID *string) {
+	switch sink.sseMode {
+	case sseModeS3:
+		return aws.String(s3.ServerSideEncryptionAes256), nil
+	case sseModeKMS:
+		return aws.String(s3.ServerSideEncryptionAwsKms), optionalString(sink.sseKMSKeyID)
+	}
+	return nil, nil
+}
+
+// Customer-provided key with which S3 encrypts objects, in the form used by the SDK, which
+// must be supplied with every request that writes or reads the object's contents
+func (sink *s3Sink) customerKey() (algorithm *string, key *string) {
+	if sink.sseCustomerKey == "" {
+		return nil, nil
+	}
+	return aws.String(s3.ServerSideEncryptionAes256), aws.String(sink.sseCustomerKey)
+}
+
+// Identify the server-side encryption settings of an upload, without revealing the customer key,
+// so that an interrupted multipart upload isn't resumed with different settings
+func (sink *s3Sink) encryptionID() string {
+	if sink.sseMode == "" || sink.sseMode == sseModeNone {
+		return ""
+	}
+	id := sink.sseMode + ":" + sink.sseKMSKeyID
+	if sink.sseCustomerKey != "" {
+		keyMD5 := md5.Sum([]byte(sink.sseCustomerKey))
+		id += ":" + base64.StdEncoding.EncodeToString(keyMD5[:])
+	}
+	return id
+}
+
+// Convert an optional string to the form used by the SDK, in which unspecified is nil
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
+
+// Path of the file tracking the multipart upload of the specified key
+func (sink *s3Sink) statePath(key string) string {
+	return sink.stateDir + strings.ReplaceAll(key, "/", " ") + multipartStateSuffix
+}
+
+// PutObject uploads an object to the bucket, using a resumable multipart upload if
+// the object is larger than the configured part size
+func (sink *s3Sink) PutObject(ctx context.Context, key string, body io.ReaderAt, size int64, opts SinkPutOptions) (err error) {
+
+	sse, kmsKeyID := sink.serverSideEncryption()
+	customerAlgorithm, customerKey := sink.customerKey()
+
+	// Small objects are uploaded in a single request
+	if size <= sink.partSize {
+		puparams := &s3.PutObjectInput{
+			Body:                 io.NewSectionReader(body, 0, size),
+			ACL:                  optionalString(opts.ACL),
+			Bucket:               sink.bucket,
+			ContentEncoding:      optionalString(opts.ContentEncoding),
+			ContentType:          optionalString(opts.ContentType),
+			Key:                  aws.String(key),
+			Metadata:             aws.StringMap(opts.Metadata),
+			SSECustomerAlgorithm: customerAlgorithm,
+			SSECustomerKey:       customerKey,
+			SSEKMSKeyId:          kmsKeyID,
+			ServerSideEncryption: sse,
+			StorageClass:         optionalString(opts.StorageClass),
+		}
+		_, err = sink.client.PutObjectWithContext(ctx, puparams)
+		if err != nil {
+			return fmt.Errorf("err uploading object: %s", err)
+		}
+		return nil
+	}
+
+	// Resume the upload where we left off if it was previously interrupted, but start
+	// over if the object being uploaded isn't the same as the one that was interrupted
+	partSize := sink.partSize
+	for (size+partSize-1)/partSize > s3MaxParts {
+		partSize *= 2
+	}
+	upload := multipartState{Key: key, Size: size, PartSize: partSize, Encryption: sink.encryptionID(), SHA256: opts.SHA256}
+	state := multipartState{}
+	stateJSON, err := os.ReadFile(sink.statePath(key))
+	if err == nil {
+		err = note.JSONUnmarshal(stateJSON, &state)
+	}
+	if err != nil || !state.resumableBy(upload) {
+		sink.AbortObject(ctx, key)
+		cmparams := &s3.CreateMultipartUploadInput{
+			ACL:                  optionalString(opts.ACL),
+			Bucket:               sink.bucket,
+			ContentEncoding:      optionalString(opts.ContentEncoding),
+			ContentType:          optionalString(opts.ContentType),
+			Key:                  aws.String(key),
+			Metadata:             aws.StringMap(opts.Metadata),
+			SSECustomerAlgorithm: customerAlgorithm,
+			SSECustomerKey:       customerKey,
+			SSEKMSKeyId:          kmsKeyID,
+			ServerSideEncryption: sse,
+			StorageClass:         optionalString(opts.StorageClass),
+		}
+		rsp, err := sink.client.CreateMultipartUploadWithContext(ctx, cmparams)
+		if err != nil {
+			return fmt.Errorf("err creating multipart upload: %s", err)
+		}
+		state = upload
+		state.UploadID = aws.StringValue(rsp.UploadId)
+		err = sink.saveState(state)
+		if err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("archive: resuming upload of %s after %d parts\n", key, len(state.Parts))
+	}
+
+	// Upload the parts that haven't yet been uploaded, saving progress after each
+	for number := int64(len(state.Parts)) + 1; (number-1)*partSize < size; number++ {
+		offset := (number - 1) * partSize
+		length := partSize
+		if offset+length > size {
+			length = size - offset
+		}
+		upparams := &s3.UploadPartInput{
+			Body:                 io.NewSectionReader(body, offset, length),
+			Bucket:               sink.bucket,
+			Key:                  aws.String(key),
+			PartNumber:           aws.Int64(number),
+			SSECustomerAlgorithm: customerAlgorithm,
+			SSECustomerKey:       customerKey,
+			UploadId:             aws.String(state.UploadID),
+		}
+		rsp, err := sink.client.UploadPartWithContext(ctx, upparams)
+		if err != nil {
+			sink.forgetLostUpload(key, err)
+			return fmt.Errorf("err uploading part %d: %s", number, err)
+		}
+		state.Parts = append(state.Parts, multipartPart{Number: number, ETag: aws.StringValue(rsp.ETag)})
+		err = sink.saveState(state)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Complete the upload
+	completedParts := []*s3.CompletedPart{}
+	for _, part := range state.Parts {
+		completedParts = append(completedParts, &s3.CompletedPart{ETag: aws.String(part.ETag), PartNumber: aws.Int64(part.Number)})
+	}
+	cuparams := &s3.CompleteMultipartUploadInput{
+		Bucket:          sink.bucket,
+		Key:             aws.String(key),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completedParts},
+		UploadId:        aws.String(state.UploadID),
+	}
+	_, err = sink.client.CompleteMultipartUploadWithContext(ctx, cuparams)
+	if err != nil {
+		sink.forgetLostUpload(key, err)
+		return fmt.Errorf("err completing multipart upload: %s", err)
+	}
+	os.Remove(sink.statePath(key))
+
+	return nil
+
+}
+
+// Save the progress of a multipart upload
+func (sink *s3Sink) saveState(state multipartState) (err error) {
+	stateJSON, err := note.JSONMarshal(state)
+	if err == nil {
+		err = writeFileAtomic(sink.statePath(state.Key), stateJSON)
+	}
+	if err != nil {
+		return fmt.Errorf("err saving multipart upload state: %s", err)
+	}
+	return nil
+}
+
+// If the service no longer knows about an upload, such as because it has expired, forget
+// about it so that the next attempt starts from the beginning rather than failing forever
+func (sink *s3Sink) forgetLostUpload(key string, err error) {
+	if aerr, ok := err.(awserr.Error); ok {
+		if aerr.Code() == s3.ErrCodeNoSuchUpload || aerr.Code() == "InvalidPart" {
+			os.Remove(sink.statePath(key))
+		}
+	}
+}
+
+// AbortObject abandons any interrupted multipart upload of the specified key, so that
+// its parts don't linger in the bucket
+func (sink *s3Sink) AbortObject(ctx context.Context, key string) (err error) {
+	stateJSON, err := os.ReadFile(sink.statePath(key))
+	if err != nil {
+		return nil
+	}
+	state := multipartState{}
+	err = note.JSONUnmarshal(stateJSON, &state)
+	if err == nil && state.UploadID != "" {
+		amparams := &s3.AbortMultipartUploadInput{
+			Bucket:   sink.bucket,
+			Key:      aws.String(state.Key),
+			UploadId: aws.String(state.UploadID),
+		}
+		_, err = sink.client.AbortMultipartUploadWithContext(ctx, amparams)
+		if err != nil {
+			fmt.Printf("archive: error aborting upload of %s: %s\n", state.Key, err)
+		}
+	}
+	os.Remove(sink.statePath(key))
+	return nil
+}
+
+// GetObject reads an object from the bucket
+func (sink *s3Sink) GetObject(ctx context.Context, key string) (body []byte, exists bool, err error) {
+	customerAlgorithm, customerKey := sink.customerKey()
+	goparams := &s3.GetObjectInput{
+		Bucket:               sink.bucket,
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: customerAlgorithm,
+		SSECustomerKey:       customerKey,
+	}
+	rsp, err := sink.client.GetObjectWithContext(ctx, goparams)
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("err getting object: %s", err)
+	}
+	defer rsp.Body.Close()
+	body, err = io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("err reading object: %s", err)
+	}
+	return body, true, nil
+}
+
+// HeadObject returns info about an object in the bucket
+func (sink *s3Sink) HeadObject(ctx context.Context, key string) (object SinkObject, exists bool, err error) {
+	customerAlgorithm, customerKey := sink.customerKey()
+	hoparams := &s3.HeadObjectInput{
+		Bucket:               sink.bucket,
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: customerAlgorithm,
+		SSECustomerKey:       customerKey,
+	}
+	rsp, err := sink.client.HeadObjectWithContext(ctx, hoparams)
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+			return object, false, nil
+		}
+		return object, false, fmt.Errorf("err getting object info: %s", err)
+	}
+	object.Key = key
+	object.Size = aws.Int64Value(rsp.ContentLength)
+	object.Modified = aws.TimeValue(rsp.LastModified)
+	return object, true, nil
+}
+
+// ListObjects lists the objects in the bucket having the specified prefix
+func (sink *s3Sink) ListObjects(ctx context.Context, prefix string) (objects []SinkObject, err error) {
+	loparams := &s3.ListObjectsV2Input{
+		Bucket: sink.bucket,
+		Prefix: aws.String(prefix),
+	}
+	err = sink.client.ListObjectsV2PagesWithContext(ctx, loparams, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.Contents {
+			object := SinkObject{}
+			object.Key = aws.StringValue(item.Key)
+			object.Size = aws.Int64Value(item.Size)
+			object.Modified = aws.TimeValue(item.LastModified)
+			objects = append(objects, object)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("err listing objects: %s", err)
+	}
+	return objects, nil
+}
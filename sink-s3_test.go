@@ -0,0 +1,40 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestMultipartResumable(t *testing.T) {
+	state := multipartState{Key: "a/1-2-3.avro", UploadID: "upload", Size: 100, PartSize: 10, Encryption: "sse", SHA256: "abc",
+		Parts: []multipartPart{{Number: 1, ETag: "etag"}}}
+	upload := multipartState{Key: "a/1-2-3.avro", Size: 100, PartSize: 10, Encryption: "sse", SHA256: "abc"}
+	if !state.resumableBy(upload) {
+		t.Errorf("expected upload of the same object to resume")
+	}
+
+	// An object that differs in any way, including only in its content, starts over, as does
+	// one whose content isn't known
+	changes := map[string]func(upload *multipartState){
+		"key":        func(upload *multipartState) { upload.Key = "a/1-2-4.avro" },
+		"size":       func(upload *multipartState) { upload.Size = 101 },
+		"part size":  func(upload *multipartState) { upload.PartSize = 20 },
+		"encryption": func(upload *multipartState) { upload.Encryption = "" },
+		"content":    func(upload *multipartState) { upload.SHA256 = "abd" },
+	}
+	for name, change := range changes {
+		changed := upload
+		change(&changed)
+		if state.resumableBy(changed) {
+			t.Errorf("expected upload with different %s not to resume", name)
+		}
+	}
+	state.SHA256 = ""
+	upload.SHA256 = ""
+	if state.resumableBy(upload) {
+		t.Errorf("expected upload without a SHA-256 not to resume")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Sink types that may be specified in a route's sink_type
+const sinkTypeS3 = "s3"
+const sinkTypeFile = "file"
+
+// SinkObject describes an object that has been stored in a sink
+type SinkObject struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+// SinkPutOptions are attributes applied to an object as it is put, along with the hex
+// SHA-256 of its body, without which an interrupted upload of it is never resumed
+type SinkPutOptions struct {
+	ContentType     string
+	ContentEncoding string
+	ACL             string
+	StorageClass    string
+	Metadata        map[string]string
+	SHA256          string
+}
+
+// Sink is a destination to which archives are written
+type Sink interface {
+
+	// PutObject writes the body to the object at the specified key, replacing it if it exists.
+	// If a previous attempt to put the same object was interrupted, it is resumed if possible.
+	PutObject(ctx context.Context, key string, body io.ReaderAt, size int64, opts SinkPutOptions) (err error)
+
+	// AbortObject discards any interrupted attempt to put the object at the specified key
+	AbortObject(ctx context.Context, key string) (err error)
+
+	// GetObject returns the contents of the object at the specified key, if it exists.  It is
+	// intended for small objects, because the contents are read into memory.
+	GetObject(ctx context.Context, key string) (body []byte, exists bool, err error)
+
+	// HeadObject returns info about the object at the specified key, if it exists
+	HeadObject(ctx context.Context, key string) (object SinkObject, exists bool, err error)
+
+	// ListObjects returns all objects whose keys begin with the specified prefix
+	ListObjects(ctx context.Context, prefix string) (objects []SinkObject, err error)
+}
+
+// Create a sink for the route's configured sink type
+func newSink(ctx context.Context, rc RouteConfig) (sink Sink, err error) {
+	switch rc.SinkType {
+	case "", sinkTypeS3:
+		return newS3Sink(ctx, rc)
+	case sinkTypeFile:
+		return newFileSink(rc)
+	}
+	return nil, fmt.Errorf("invalid sink type: %s", rc.SinkType)
+}
+
+// Reader that fails once its context is done, so that a long copy may be abandoned
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read fails if the context is done, and otherwise reads from the underlying reader
+func (cr *contextReader) Read(p []byte) (n int, err error) {
+	err = cr.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
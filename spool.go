@@ -0,0 +1,727 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Append-only segment log in which incoming events are spooled until they are archived.
+//
+// Each folder's events are appended to a segment file named
+// "<folder> <arrivedUs>-<segmentID>.log", where arrivedUs is the time at which the segment was
+// started, alongside an index file of the same name ending in ".idx" that has a fixed-size
+// entry for each event.  The index enables the archiver to learn the count and time range of the events
+// in a segment, and to detect retries of events that are already spooled, without reading the
+// events themselves.  Segments are sealed when the archiver picks them up, after which events
+// for the same folder are appended to a new segment.  On startup, segments are scanned and any
+// record left partially written by a crash is truncated, and indexes are rebuilt as needed.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blues/note-go/note"
+	"github.com/google/uuid"
+)
+
+// Spool file suffixes
+const spoolLogSuffix = ".log"
+const spoolIndexSuffix = ".idx"
+
+// Segments are rolled over when they reach this size
+const spoolMaxSegmentSize = 64 * 1024 * 1024
+
+// Each record is a header followed by the event JSON, which is encrypted if encryption at
+// rest is enabled.  The header contains the length of the event JSON, a CRC of everything
+// following the CRC, the event's received time, and a hash of the event's UID.  Each index
+// entry contains the offset of the record, the received time, and the UID hash.
+const spoolRecordHeaderSize = 24
+const spoolIndexEntrySize = 24
+
+// Largest event JSON that a record may hold.  Larger events are refused when spooled, so a
+// header claiming a larger length when read is taken to be torn or corrupt.
+const spoolMaxRecordSize = 32 * 1024 * 1024
+
+// Environment variable selecting when spooled events are flushed to disk.  "always" flushes
+// each event before it is acknowledged, "interval" flushes every spoolFsyncPeriod, and
+// "none" leaves it to the operating system.
+const spoolFsyncEnv = "ARCHIVE_SPOOL_FSYNC"
+const spoolFsyncAlways = "always"
+const spoolFsyncInterval = "interval"
+const spoolFsyncNone = "none"
+const spoolFsyncPeriod = time.Duration(1) * time.Second
+
+// Info about a segment, gathered from its name and index, where Arrived is the time at which
+// its first event arrived on the server, and First and Last are the times of its earliest and
+// latest events according to their route's time_basis
+type spoolSegment struct {
+	Name    string
+	Folder  string
+	Arrived int64
+	First   int64
+	Last    int64
+	Count   int
+}
+
+// A record within a segment, whose event JSON may be encrypted
+type spoolRecord struct {
+	ReceivedUs int64
+	UIDHash    uint64
+	EventJSON  []byte
+}
+
+// Key of a folder within the spool
+type spoolFolderKey struct {
+	archiveID string
+	folder    string
+}
+
+// Append state of a folder, including the names of its segments so that appending to,
+// sealing, or removing from a folder never requires scanning the rest of the spool, and the
+// time at which its oldest segment arrived and its count of events so that it is known when
+// it becomes due
+type spoolFolder struct {
+	active     string
+	activeSize int64
+	segments   map[string]bool
+	uids       map[uint64]bool
+	arrived    int64
+	count      int
+}
+
+// Spool state, all protected by the lock.  The folders of an archive are loaded from its
+// segments when it is first used, after which a folder without state has no segments.
+var spoolLock sync.Mutex
+var spoolFolders = map[spoolFolderKey]*spoolFolder{}
+var spoolLoaded = map[string]bool{}
+var spoolDirty = map[string]bool{}
+var spoolFsync = spoolFsyncInterval
+
+// Initialize the spool, recovering segments that were being written when the server
+// stopped, and converting events spooled as individual files by earlier versions
+func spoolInit() {
+
+	switch os.Getenv(spoolFsyncEnv) {
+	case spoolFsyncAlways:
+		spoolFsync = spoolFsyncAlways
+	case spoolFsyncNone:
+		spoolFsync = spoolFsyncNone
+	}
+
+	dataDir, err := os.Open(configDataPath(""))
+	if err == nil {
+		archiveIDFiles, _ := dataDir.ReadDir(0)
+		dataDir.Close()
+		for _, archiveIDFile := range archiveIDFiles {
+			if archiveIDFile.IsDir() {
+				spoolRecover(archiveIDFile.Name())
+			}
+		}
+	}
+
+	if spoolFsync == spoolFsyncInterval {
+		go spoolFlusher()
+	}
+
+}
+
+// Periodically flush segments that have been written since the last flush
+func spoolFlusher() {
+	for {
+		time.Sleep(spoolFsyncPeriod)
+		spoolLock.Lock()
+		dirty := spoolDirty
+		spoolDirty = map[string]bool{}
+		spoolLock.Unlock()
+		for filePath := range dirty {
+			file, err := os.OpenFile(filePath, os.O_WRONLY, 0644)
+			if err == nil {
+				file.Sync()
+				file.Close()
+			}
+		}
+	}
+}
+
+// Recover all segments of an archive, and migrate its legacy event files
+func spoolRecover(archiveID string) {
+
+	incomingPath := configDataPath(archiveID + instanceIncomingEvents)
+	incomingDir, err := os.Open(incomingPath)
+	if err != nil {
+		return
+	}
+	files, _ := incomingDir.ReadDir(0)
+	incomingDir.Close()
+
+	legacyFiles := []string{}
+	for _, file := range files {
+		filename := file.Name()
+		if strings.HasPrefix(filename, ".") || strings.HasSuffix(filename, ".temp") {
+			os.Remove(incomingPath + filename)
+		} else if strings.HasSuffix(filename, spoolLogSuffix) {
+			err = spoolRecoverSegment(incomingPath + strings.TrimSuffix(filename, spoolLogSuffix))
+			if err != nil {
+				fmt.Printf("spool: error recovering %s: %s\n", filename, err)
+			}
+		} else if !strings.HasSuffix(filename, spoolIndexSuffix) {
+			legacyFiles = append(legacyFiles, filename)
+		}
+	}
+
+	sort.Strings(legacyFiles)
+	for _, filename := range legacyFiles {
+		folder, receivedUs, valid := parseSpoolFilename(filename)
+		if !valid {
+			continue
+		}
+		eventJSON, err := os.ReadFile(incomingPath + filename)
+		if err != nil {
+			continue
+		}
+		var event note.Event
+		note.JSONUnmarshal(eventJSON, &event)
+		_, _, err = spoolAppend(archiveID, folder, receivedUs, event.EventUID, eventJSON)
+		if err != nil {
+			fmt.Printf("spool: error migrating %s: %s\n", filename, err)
+			continue
+		}
+		os.Remove(incomingPath + filename)
+	}
+	if len(legacyFiles) > 0 {
+		fmt.Printf("spool: %s migrated %d event files to segments\n", archiveID, len(legacyFiles))
+	}
+
+}
+
+// Recover a segment, truncating a partially-written record at its end, and rebuilding its
+// index if it doesn't match the records in the segment
+func spoolRecoverSegment(basePath string) (err error) {
+
+	index := []byte{}
+	offset := int64(0)
+	err = spoolReadSegment(basePath, func(record spoolRecord) error {
+		index = append(index, spoolIndexEntry(offset, record.ReceivedUs, record.UIDHash)...)
+		offset += int64(spoolRecordHeaderSize + len(record.EventJSON))
+		return nil
+	})
+	if err != nil && err != errSpoolTruncated {
+		return err
+	}
+	if err == errSpoolTruncated {
+		fmt.Printf("spool: truncating partially-written segment %s at %d\n", basePath, offset)
+		err = os.Truncate(basePath+spoolLogSuffix, offset)
+		if err != nil {
+			return err
+		}
+	}
+
+	existingIndex, _ := os.ReadFile(basePath + spoolIndexSuffix)
+	if string(existingIndex) != string(index) {
+		err = writeFileAtomic(basePath+spoolIndexSuffix, index)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// Hash an event UID for deduplication, with zero meaning that the event has no UID
+func spoolUIDHash(eventUID string) uint64 {
+	if eventUID == "" {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(eventUID))
+	hash := h.Sum64()
+	if hash == 0 {
+		hash = 1
+	}
+	return hash
+}
+
+// Format an index entry
+func spoolIndexEntry(offset int64, receivedUs int64, uidHash uint64) []byte {
+	entry := make([]byte, spoolIndexEntrySize)
+	binary.BigEndian.PutUint64(entry[0:], uint64(offset))
+	binary.BigEndian.PutUint64(entry[8:], uint64(receivedUs))
+	binary.BigEndian.PutUint64(entry[16:], uidHash)
+	return entry
+}
+
+// Read the entries of an index, ignoring a partially-written entry at the end
+func spoolReadIndex(basePath string) (receivedUs []int64, uidHashes []uint64, err error) {
+	index, err := os.ReadFile(basePath + spoolIndexSuffix)
+	if err != nil {
+		return
+	}
+	for i := 0; i+spoolIndexEntrySize <= len(index); i += spoolIndexEntrySize {
+		receivedUs = append(receivedUs, int64(binary.BigEndian.Uint64(index[i+8:])))
+		uidHashes = append(uidHashes, binary.BigEndian.Uint64(index[i+16:]))
+	}
+	return
+}
+
+// Load the append state of every folder of an archive from its segments, if it hasn't
+// already been loaded, which must be called with the lock held
+func spoolLoadArchive(archiveID string) (err error) {
+	if spoolLoaded[archiveID] {
+		return nil
+	}
+	incomingPath := configDataPath(archiveID + instanceIncomingEvents)
+	incomingDir, err := os.Open(incomingPath)
+	if err != nil {
+		return err
+	}
+	files, err := incomingDir.ReadDir(0)
+	incomingDir.Close()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		filename := file.Name()
+		if !strings.HasSuffix(filename, spoolLogSuffix) || strings.HasPrefix(filename, ".") {
+			continue
+		}
+		name := strings.TrimSuffix(filename, spoolLogSuffix)
+		folder, _, valid := parseSpoolFilename(name)
+		if !valid {
+			continue
+		}
+		state := spoolNewFolder(spoolFolderKey{archiveID, folder})
+		receivedUs, uidHashes, _ := spoolReadIndex(incomingPath + name)
+		state.addSegment(name, receivedUs, uidHashes)
+	}
+	spoolLoaded[archiveID] = true
+	return nil
+}
+
+// Return the state of a folder, creating empty state if it has none, which must be called
+// with the lock held
+func spoolNewFolder(key spoolFolderKey) (state *spoolFolder) {
+	state, present := spoolFolders[key]
+	if !present {
+		state = &spoolFolder{segments: map[string]bool{}, uids: map[uint64]bool{}}
+		spoolFolders[key] = state
+	}
+	return state
+}
+
+// Add a segment, along with the entries of its index, to a folder's state
+func (state *spoolFolder) addSegment(name string, receivedUs []int64, uidHashes []uint64) {
+	_, arrivedUs, _ := parseSpoolFilename(name)
+	if len(state.segments) == 0 || arrivedUs < state.arrived {
+		state.arrived = arrivedUs
+	}
+	state.segments[name] = true
+	state.addIndex(receivedUs, uidHashes)
+}
+
+// Add the entries of a segment's index to a folder's state
+func (state *spoolFolder) addIndex(receivedUs []int64, uidHashes []uint64) {
+	state.count += len(receivedUs)
+	for _, uidHash := range uidHashes {
+		if uidHash != 0 {
+			state.uids[uidHash] = true
+		}
+	}
+}
+
+// Load the append state of a folder, which must be called with the lock held
+func spoolLoadFolder(key spoolFolderKey) (state *spoolFolder, err error) {
+	err = spoolLoadArchive(key.archiveID)
+	if err != nil {
+		return nil, err
+	}
+	return spoolNewFolder(key), nil
+}
+
+// Append an event to a folder's active segment, returning false if the event is a retry
+// of an event that has already been spooled but not yet archived, along with a batch
+// summarizing the folder's spooled events, without their segments, by which the caller may
+// determine when the folder is due.  The time recorded as received is the event's time
+// according to its route's time_basis.
+func spoolAppend(archiveID string, folder string, receivedUs int64, eventUID string, eventJSON []byte) (added bool, batch archiveBatch, err error) {
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+
+	key := spoolFolderKey{archiveID, folder}
+	state, err := spoolLoadFolder(key)
+	if err != nil {
+		return false, batch, err
+	}
+	uidHash := spoolUIDHash(eventUID)
+	if uidHash != 0 && state.uids[uidHash] {
+		return false, state.batch(folder), nil
+	}
+	payload, err := atRestSeal(archiveID, eventJSON)
+	if err != nil {
+		return false, batch, err
+	}
+	if len(payload) > spoolMaxRecordSize {
+		return false, batch, fmt.Errorf("event of %d bytes is too large to spool", len(eventJSON))
+	}
+
+	// Start a new segment if there's no active segment, or if it's full.  The segment is
+	// named for the time at which it was started, which is when its first event arrived.
+	if state.active == "" || state.activeSize >= spoolMaxSegmentSize {
+		state.active = fmt.Sprintf("%s %d-%s", folder, time.Now().UnixMicro(), uuid.New().String())
+		state.activeSize = 0
+		state.addSegment(state.active, nil, nil)
+	}
+	basePath := configDataPath(archiveID+instanceIncomingEvents) + state.active
+
+	// Append the record and then its index entry
+	record := spoolEncodeRecord(spoolRecord{ReceivedUs: receivedUs, UIDHash: uidHash, EventJSON: payload})
+	err = spoolWrite(basePath+spoolLogSuffix, record)
+	if err != nil {
+		state.active = ""
+		return false, batch, err
+	}
+	err = spoolWrite(basePath+spoolIndexSuffix, spoolIndexEntry(state.activeSize, receivedUs, uidHash))
+	if err != nil {
+		state.active = ""
+		return false, batch, err
+	}
+	state.activeSize += int64(len(record))
+	state.addIndex([]int64{receivedUs}, []uint64{uidHash})
+
+	return true, state.batch(folder), nil
+}
+
+// Summarize a folder's spooled events as a batch, without its segments
+func (state *spoolFolder) batch(folder string) archiveBatch {
+	return archiveBatch{Folder: folder, Arrived: state.arrived, Count: state.count}
+}
+
+// Format a record, with its header
+func spoolEncodeRecord(record spoolRecord) []byte {
+	encoded := make([]byte, spoolRecordHeaderSize, spoolRecordHeaderSize+len(record.EventJSON))
+	binary.BigEndian.PutUint32(encoded[0:], uint32(len(record.EventJSON)))
+	binary.BigEndian.PutUint64(encoded[8:], uint64(record.ReceivedUs))
+	binary.BigEndian.PutUint64(encoded[16:], record.UIDHash)
+	encoded = append(encoded, record.EventJSON...)
+	binary.BigEndian.PutUint32(encoded[4:], crc32.ChecksumIEEE(encoded[8:]))
+	return encoded
+}
+
+// Write records, exactly as they were read from the spool, to a complete segment in the
+// specified directory.  The segment's name is derived from its folder and first record, so
+// writing the same records again replaces the segment rather than duplicating it.
+func spoolWriteSegment(dirPath string, folder string, records []spoolRecord) (err error) {
+	if len(records) == 0 {
+		return nil
+	}
+	segment := []byte{}
+	index := []byte{}
+	for _, record := range records {
+		index = append(index, spoolIndexEntry(int64(len(segment)), record.ReceivedUs, record.UIDHash)...)
+		segment = append(segment, spoolEncodeRecord(record)...)
+	}
+	basePath := dirPath + fmt.Sprintf("%s %d-%016x", folder, records[0].ReceivedUs, records[0].UIDHash)
+	err = writeFileAtomic(basePath+spoolLogSuffix, segment)
+	if err == nil {
+		err = writeFileAtomic(basePath+spoolIndexSuffix, index)
+	}
+	return err
+}
+
+// Append to a spool file, flushing it according to the fsync policy
+func spoolWrite(filePath string, data []byte) (err error) {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil && spoolFsync == spoolFsyncAlways {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil && spoolFsync == spoolFsyncInterval {
+		spoolDirty[filePath] = true
+	}
+	return err
+}
+
+// Error indicating that a segment ends with a partially-written record
+var errSpoolTruncated = fmt.Errorf("segment ends with a partial record")
+
+// Read each record of a segment in sequence.  The length in each record's header is checked
+// against the rest of the file and spoolMaxRecordSize before anything is allocated for the
+// record, so that a torn or corrupt header is treated as a partial record.
+func spoolReadSegment(basePath string, fn func(record spoolRecord) error) (err error) {
+	file, err := os.Open(basePath + spoolLogSuffix)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	remaining := info.Size()
+	reader := bufio.NewReader(file)
+	header := make([]byte, spoolRecordHeaderSize)
+	for {
+		_, err = io.ReadFull(reader, header)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errSpoolTruncated
+		}
+		remaining -= spoolRecordHeaderSize
+		length := int64(binary.BigEndian.Uint32(header[0:]))
+		if length > spoolMaxRecordSize || length > remaining {
+			return errSpoolTruncated
+		}
+		remaining -= length
+		body := make([]byte, spoolRecordHeaderSize-8+int(length))
+		copy(body, header[8:])
+		_, err = io.ReadFull(reader, body[spoolRecordHeaderSize-8:])
+		if err != nil || crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+			return errSpoolTruncated
+		}
+		record := spoolRecord{}
+		record.ReceivedUs = int64(binary.BigEndian.Uint64(header[8:]))
+		record.UIDHash = binary.BigEndian.Uint64(header[16:])
+		record.EventJSON = body[spoolRecordHeaderSize-8:]
+		err = fn(record)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// List all segments of an archive, sorted by folder and then by the time of their first event
+func spoolSegments(archiveID string) (segments []spoolSegment, err error) {
+	incomingPath := configDataPath(archiveID + instanceIncomingEvents)
+	incomingDir, err := os.Open(incomingPath)
+	if err != nil {
+		return nil, err
+	}
+	files, err := incomingDir.ReadDir(0)
+	incomingDir.Close()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		filename := file.Name()
+		if !strings.HasSuffix(filename, spoolLogSuffix) || strings.HasPrefix(filename, ".") {
+			continue
+		}
+		segment, valid := spoolSegmentInfo(incomingPath, strings.TrimSuffix(filename, spoolLogSuffix))
+		if valid {
+			segments = append(segments, segment)
+		}
+	}
+	sortSpoolSegments(segments)
+	return segments, nil
+}
+
+// Gather info about a segment from its name and index, returning false if it has no events
+func spoolSegmentInfo(dirPath string, name string) (segment spoolSegment, valid bool) {
+	segment.Name = name
+	segment.Folder, segment.Arrived, _ = parseSpoolFilename(name)
+	receivedUs, _, err := spoolReadIndex(dirPath + name)
+	if err != nil || len(receivedUs) == 0 {
+		return segment, false
+	}
+	segment.Count = len(receivedUs)
+	for _, us := range receivedUs {
+		if segment.First == 0 || us < segment.First {
+			segment.First = us
+		}
+		if us > segment.Last {
+			segment.Last = us
+		}
+	}
+	return segment, true
+}
+
+// Sort segments by folder, and then by the time of their first event.  They are sorted by
+// folder rather than by name, because folder names may contain spaces.
+func sortSpoolSegments(segments []spoolSegment) {
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].Folder != segments[j].Folder {
+			return segments[i].Folder < segments[j].Folder
+		}
+		if segments[i].First != segments[j].First {
+			return segments[i].First < segments[j].First
+		}
+		return segments[i].Name < segments[j].Name
+	})
+}
+
+// List the segments of a single folder, reading only the indexes of that folder's segments,
+// which must be called with the lock held
+func spoolFolderSegments(archiveID string, folder string) (segments []spoolSegment, err error) {
+	err = spoolLoadArchive(archiveID)
+	if err != nil {
+		return nil, err
+	}
+	state, present := spoolFolders[spoolFolderKey{archiveID, folder}]
+	if !present {
+		return nil, nil
+	}
+	incomingPath := configDataPath(archiveID + instanceIncomingEvents)
+	for name := range state.segments {
+		segment, valid := spoolSegmentInfo(incomingPath, name)
+		if valid {
+			segments = append(segments, segment)
+		}
+	}
+	sortSpoolSegments(segments)
+	return segments, nil
+}
+
+// Seal a folder's segments so that no further events are appended to them, returning them
+// so that they may be archived.  Events subsequently received are appended to a new segment.
+func spoolSeal(archiveID string, folder string) (segments []spoolSegment, err error) {
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+	state, present := spoolFolders[spoolFolderKey{archiveID, folder}]
+	if present {
+		state.active = ""
+	}
+	return spoolFolderSegments(archiveID, folder)
+}
+
+// Remove segments that have been archived
+func spoolRemove(archiveID string, folder string, segments []spoolSegment) {
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+	incomingPath := configDataPath(archiveID + instanceIncomingEvents)
+	removed := []string{}
+	for _, segment := range segments {
+		os.Remove(incomingPath + segment.Name + spoolLogSuffix)
+		os.Remove(incomingPath + segment.Name + spoolIndexSuffix)
+		delete(spoolDirty, incomingPath+segment.Name+spoolLogSuffix)
+		delete(spoolDirty, incomingPath+segment.Name+spoolIndexSuffix)
+		removed = append(removed, segment.Name)
+	}
+	spoolReloadFolder(spoolFolderKey{archiveID, folder}, removed)
+}
+
+// Move sealed segments out of the spool into the specified directory
+func spoolMove(archiveID string, folder string, segments []spoolSegment, dirPath string) (err error) {
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+	incomingPath := configDataPath(archiveID + instanceIncomingEvents)
+	moved := []string{}
+	for _, segment := range segments {
+		for _, suffix := range []string{spoolLogSuffix, spoolIndexSuffix} {
+			err = os.Rename(incomingPath+segment.Name+suffix, dirPath+segment.Name+suffix)
+			if err != nil {
+				break
+			}
+			delete(spoolDirty, incomingPath+segment.Name+suffix)
+		}
+		if err != nil {
+			break
+		}
+		moved = append(moved, segment.Name)
+	}
+	spoolReloadFolder(spoolFolderKey{archiveID, folder}, moved)
+	return err
+}
+
+// Move the segments in the specified directory back into the spool, returning the number of
+// events that they contain
+func spoolRestore(archiveID string, dirPath string) (count int, err error) {
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+	files, err := os.ReadDir(dirPath)
+	if err != nil {
+		return 0, err
+	}
+	err = spoolLoadArchive(archiveID)
+	if err != nil {
+		return 0, err
+	}
+	incomingPath := configDataPath(archiveID + instanceIncomingEvents)
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), spoolLogSuffix) {
+			continue
+		}
+		name := strings.TrimSuffix(file.Name(), spoolLogSuffix)
+		folder, _, valid := parseSpoolFilename(name)
+		if !valid {
+			continue
+		}
+		receivedUs, uidHashes, _ := spoolReadIndex(dirPath + name)
+		err = os.Rename(dirPath+name+spoolIndexSuffix, incomingPath+name+spoolIndexSuffix)
+		if err == nil {
+			err = os.Rename(dirPath+name+spoolLogSuffix, incomingPath+name+spoolLogSuffix)
+		}
+		if err != nil {
+			return count, err
+		}
+		count += len(receivedUs)
+		state := spoolNewFolder(spoolFolderKey{archiveID, folder})
+		state.addSegment(name, receivedUs, uidHashes)
+	}
+	return count, nil
+}
+
+// Forget segments that have been removed from a folder, reloading its UIDs, arrival time, and
+// count from its remaining segments, and dropping its state if none remain.  This must be
+// called with the lock held.
+func spoolReloadFolder(key spoolFolderKey, removed []string) {
+	state, present := spoolFolders[key]
+	if !present {
+		return
+	}
+	for _, name := range removed {
+		delete(state.segments, name)
+		if name == state.active {
+			state.active = ""
+		}
+	}
+	if len(state.segments) == 0 {
+		delete(spoolFolders, key)
+		return
+	}
+	names := state.segments
+	state.segments = map[string]bool{}
+	state.uids = map[uint64]bool{}
+	state.count = 0
+	incomingPath := configDataPath(key.archiveID + instanceIncomingEvents)
+	for name := range names {
+		receivedUs, uidHashes, _ := spoolReadIndex(incomingPath + name)
+		state.addSegment(name, receivedUs, uidHashes)
+	}
+}
+
+// Parse a segment or legacy event filename into its folder and time.  Segments are named
+// "<folder> <arrivedUs>-<segmentID>", where arrivedUs is the time at which the segment was
+// started, except that those written to the dead letter directory are named for the time of
+// their first event, "<folder> <firstUs>-<uidHash>".  Legacy event files are named
+// "<folder> <receivedUs>-<eventUID>" or "<folder> <receivedUs>".
+func parseSpoolFilename(filename string) (folder string, timeUs int64, valid bool) {
+	index := strings.LastIndex(filename, " ")
+	if index == -1 {
+		return "", 0, false
+	}
+	folder = filename[:index]
+	timeField := filename[index+1:]
+	uidIndex := strings.Index(timeField, "-")
+	if uidIndex > 0 {
+		timeField = timeField[:uidIndex]
+	}
+	timeUs, err := strconv.ParseInt(timeField, 10, 64)
+	if err != nil || timeUs == 0 {
+		return "", 0, false
+	}
+	return folder, timeUs, true
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestSpoolRecoverCorruptLength(t *testing.T) {
+	valid := spoolEncodeRecord(spoolRecord{ReceivedUs: 1656000000000000, UIDHash: 1, EventJSON: []byte(`{"event":"e1"}`)})
+	tests := []struct {
+		name   string
+		length uint32
+	}{
+		{"beyond file", 1024 * 1024},
+		{"beyond maximum", spoolMaxRecordSize + 1},
+		{"maximum", spoolMaxRecordSize},
+		{"huge", 0xffffffff},
+	}
+	for _, test := range tests {
+		basePath := t.TempDir() + "/segment"
+		torn := spoolEncodeRecord(spoolRecord{ReceivedUs: 1656000001000000, UIDHash: 2, EventJSON: []byte(`{"event":"e2"}`)})
+		binary.BigEndian.PutUint32(torn[0:], test.length)
+		err := os.WriteFile(basePath+spoolLogSuffix, append(append([]byte{}, valid...), torn...), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The length must be rejected before a buffer of that size is allocated
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		err = spoolRecoverSegment(basePath)
+		runtime.ReadMemStats(&after)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated >= uint64(test.length) {
+			t.Errorf("%s: expected no allocation for the torn record, allocated %d bytes", test.name, allocated)
+		}
+
+		info, err := os.Stat(basePath + spoolLogSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(len(valid)) {
+			t.Errorf("%s: expected segment to be truncated to %d bytes, got %d", test.name, len(valid), info.Size())
+		}
+		receivedUs, _, err := spoolReadIndex(basePath)
+		if err != nil || len(receivedUs) != 1 || receivedUs[0] != 1656000000000000 {
+			t.Errorf("%s: expected index of the valid record, got %v %v", test.name, receivedUs, err)
+		}
+	}
+}
+
+func TestSpoolAppendTooLarge(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	spoolFolders = map[spoolFolderKey]*spoolFolder{}
+	spoolLoaded = map[string]bool{}
+
+	eventJSON := make([]byte, spoolMaxRecordSize+1)
+	added, _, err := spoolAppend("test", "", 1656000000000000, "", eventJSON)
+	if err == nil || added {
+		t.Errorf("expected an event larger than a record to be refused")
+	}
+}
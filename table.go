@@ -0,0 +1,229 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Generation of the DDL of a Glue/Hive-compatible table over a partitioned archive, which is
+// written alongside the archive's files so that it can be run in Athena or Trino to query
+// them.  Data columns that are also partitions are left out, because their values are the same,
+// other than those of CSV files, which are renamed.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blues/note-go/note"
+)
+
+// Name of the DDL object within the table's location.  The leading underscore causes it to be
+// ignored by query engines that treat the location as a table.
+const tableDDLObjectName = "_table.sql"
+
+// Location of a table's DDL within the sink of an archive
+type tableDDLLocation struct {
+	archiveID  string
+	bucketName string
+	key        string
+}
+
+// DDL most recently written to or found at each location, so that the DDL is only read
+// back from the sink the first time that an archive is uploaded after the server starts.
+// Protected by the lock, because archives are uploaded concurrently.
+var tableDDLLock sync.Mutex
+var tableDDLWritten = map[tableDDLLocation]string{}
+
+// Validate a table name, which may only contain lowercase letters, digits, and underscores
+func validFileTable(table string) (err error) {
+	if table == "" {
+		return fmt.Errorf("file_table must not be empty")
+	}
+	for _, ch := range table {
+		if !((ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') || ch == '_') {
+			return fmt.Errorf("file_table may only contain lowercase letters, digits, and underscores")
+		}
+	}
+	return nil
+}
+
+// Make a name valid as a column name
+func tableColumnName(name string) string {
+	return strings.Map(func(ch rune) rune {
+		if (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') || ch == '_' {
+			return ch
+		}
+		if ch >= 'A' && ch <= 'Z' {
+			return ch - 'A' + 'a'
+		}
+		return '_'
+	}, name)
+}
+
+// Column type of a field of the specified kind, where JSON timestamps are the seconds that
+// appear in the events
+func tableColumnType(kind string, json bool) string {
+	switch kind {
+	case fieldKindDouble:
+		return "double"
+	case fieldKindInt64:
+		return "bigint"
+	case fieldKindBoolean:
+		return "boolean"
+	case fieldKindTimestamp:
+		if json {
+			return "double"
+		}
+		return "timestamp"
+	}
+	return "string"
+}
+
+// Key of the table's DDL, within the location of the table
+func tableDDLKey(rc RouteConfig) string {
+	location, _, _ := parseHivePartitions(rc.FileFolder)
+	location = cleanKey(expandFolderTemplate(location, rc.ArchiveID, note.Event{}, nil, time.Now()))
+	return strings.TrimPrefix(path.Join(location, tableDDLObjectName), "/")
+}
+
+// Generate the DDL of the route's table
+func tableDDL(rc RouteConfig) (ddl string, err error) {
+	_, partitions, err := parseHivePartitions(rc.FileFolder)
+	if err != nil {
+		return "", err
+	}
+	isPartition := map[string]bool{}
+	for _, name := range partitions {
+		isPartition[name] = true
+	}
+
+	// Determine the data columns of the file format, whose names are case-insensitive and must
+	// be unique, including among the partitions
+	columns := []string{}
+	names := map[string]bool{}
+	for _, name := range partitions {
+		names[strings.ToLower(name)] = true
+	}
+	switch rc.FileFormat {
+	case "ndjson", fileFormatParquet:
+		fields := append([]eventField{}, eventEnvelopeFields...)
+		if rc.FileFormat == fileFormatParquet && rc.FileSchema != "" {
+			bodyFields, err := parseParquetSchema(rc.FileSchema)
+			if err != nil {
+				return "", err
+			}
+			fields = append(fields, bodyFields...)
+		}
+		for _, field := range fields {
+			if isPartition[field.Column] {
+				continue
+			}
+			if names[strings.ToLower(field.Column)] {
+				return "", fmt.Errorf("file_table would have more than one column named %s", strings.ToLower(field.Column))
+			}
+			names[strings.ToLower(field.Column)] = true
+			columns = append(columns, fmt.Sprintf("`%s` %s", field.Column, tableColumnType(field.Kind, rc.FileFormat == "ndjson")))
+		}
+	case fileFormatCSV:
+		// CSV columns are read by position, so those that are also partitions are renamed
+		fileColumns := rc.FileColumns
+		if fileColumns == "" {
+			fileColumns = defaultFileColumns
+		}
+		csvColumns, err := parseCSVColumns(fileColumns)
+		if err != nil {
+			return "", err
+		}
+		for _, column := range csvColumns {
+			name := tableColumnName(column.Name)
+			if isPartition[name] {
+				name += "_column"
+			}
+			if names[name] {
+				return "", fmt.Errorf("file_table would have more than one column named %s, because file_columns %s is renamed to it", name, column.Name)
+			}
+			names[name] = true
+			columns = append(columns, fmt.Sprintf("`%s` string", name))
+		}
+	default:
+		return "", fmt.Errorf("file_table may only be used with file_format ndjson, parquet, or csv")
+	}
+
+	location := path.Dir(tableDDLKey(rc))
+	if location == "." {
+		location = ""
+	} else {
+		location += "/"
+	}
+	if rc.SinkType == sinkTypeFile {
+		location = "file://" + configSinkPath(rc.BucketName) + location
+	} else {
+		location = "s3://" + rc.BucketName + "/" + location
+	}
+
+	clauses := []string{fmt.Sprintf("CREATE EXTERNAL TABLE IF NOT EXISTS `%s` (\n  %s\n)", rc.FileTable, strings.Join(columns, ",\n  "))}
+	partitionColumns := []string{}
+	for _, name := range partitions {
+		partitionColumns = append(partitionColumns, fmt.Sprintf("`%s` string", name))
+	}
+	clauses = append(clauses, fmt.Sprintf("PARTITIONED BY (\n  %s\n)", strings.Join(partitionColumns, ",\n  ")))
+	switch rc.FileFormat {
+	case "ndjson":
+		clauses = append(clauses, "ROW FORMAT SERDE 'org.openx.data.jsonserde.JsonSerDe'")
+	case fileFormatParquet:
+		clauses = append(clauses, "STORED AS PARQUET")
+	case fileFormatCSV:
+		clauses = append(clauses, "ROW FORMAT SERDE 'org.apache.hadoop.hive.serde2.OpenCSVSerde'")
+	}
+	clauses = append(clauses, fmt.Sprintf("LOCATION '%s'", location))
+	if rc.FileFormat == fileFormatCSV {
+		clauses = append(clauses, "TBLPROPERTIES ('skip.header.line.count'='1')")
+	}
+	ddl = strings.Join(clauses, "\n") + ";\n\n"
+	ddl += "-- Load the partitions that have been uploaded\n"
+	ddl += fmt.Sprintf("MSCK REPAIR TABLE `%s`;\n", rc.FileTable)
+	return ddl, nil
+}
+
+// Write the route's table DDL if it has changed, such as because the route's file_format
+// or file_folder have changed
+func updateTableDDL(ctx context.Context, rc RouteConfig, sink Sink) (err error) {
+	ddl, err := tableDDL(rc)
+	if err != nil {
+		return err
+	}
+	key := tableDDLKey(rc)
+	location := tableDDLLocation{rc.ArchiveID, rc.BucketName, key}
+	tableDDLLock.Lock()
+	written, cached := tableDDLWritten[location]
+	tableDDLLock.Unlock()
+	if cached && written == ddl {
+		return nil
+	}
+	if !cached {
+		existing, exists, err := sink.GetObject(ctx, key)
+		if err != nil {
+			return fmt.Errorf("can't read table DDL %s: %s", key, err)
+		}
+		if exists && bytes.Equal(existing, []byte(ddl)) {
+			tableDDLLock.Lock()
+			tableDDLWritten[location] = ddl
+			tableDDLLock.Unlock()
+			return nil
+		}
+	}
+	opts := SinkPutOptions{}
+	opts.ContentType = "application/sql"
+	opts.ACL = s3ObjectACL(rc)
+	err = sink.PutObject(ctx, key, strings.NewReader(ddl), int64(len(ddl)), opts)
+	if err != nil {
+		return fmt.Errorf("can't write table DDL %s: %s", key, err)
+	}
+	tableDDLLock.Lock()
+	tableDDLWritten[location] = ddl
+	tableDDLLock.Unlock()
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTableDDLRejectsDuplicateColumns(t *testing.T) {
+	tests := []struct {
+		fileFormat  string
+		fileColumns string
+		fileSchema  string
+		valid       bool
+	}{
+		{fileFormatCSV, "device,temp=body.temp", "", true},
+		{fileFormatCSV, "Temp=body.temp,temp=body.t", "", false},
+		{fileFormatCSV, "a-b=body.x,a_b=body.y", "", false},
+		{fileFormatCSV, "year=body.year,year_column=body.y", "", false},
+		{fileFormatCSV, "year=body.year", "", true},
+		{fileFormatParquet, "", "temp:double,Temp:double", false},
+		{fileFormatParquet, "", "temp:double,humid:double", true},
+	}
+	for _, test := range tests {
+		rc := RouteConfig{ArchiveID: "test", FileFormat: test.fileFormat, FileColumns: test.fileColumns, FileSchema: test.fileSchema,
+			FileFolder: "[id]/[year]", FilePartition: filePartitionHive, FileTable: "events", BucketName: "test"}
+		_, err := tableDDL(rc)
+		if (err == nil) != test.valid {
+			t.Errorf("%s %s%s: expected valid %v, got %v", test.fileFormat, test.fileColumns, test.fileSchema, test.valid, err)
+		}
+	}
+}
+
+// File sink that counts the objects read from it
+type countingSink struct {
+	*fileSink
+	gets int
+}
+
+func (sink *countingSink) GetObject(ctx context.Context, key string) (body []byte, exists bool, err error) {
+	sink.gets++
+	return sink.fileSink.GetObject(ctx, key)
+}
+
+func TestUpdateTableDDLCaches(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	rc := RouteConfig{ArchiveID: "test", FileFormat: "ndjson", FileFolder: "[id]/[year]", FilePartition: filePartitionHive,
+		FileTable: "events", SinkType: sinkTypeFile, BucketName: "test"}
+	fileSink, err := newFileSink(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &countingSink{fileSink: fileSink}
+	ctx := context.Background()
+
+	// The DDL is read back only once, and rewritten only when it changes
+	for i := 0; i < 3; i++ {
+		err = updateTableDDL(ctx, rc, sink)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sink.gets != 1 {
+		t.Errorf("expected DDL to be read once, got %d", sink.gets)
+	}
+	rc.FileTable = "renamed"
+	err = updateTableDDL(ctx, rc, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ddl, _, _ := sink.GetObject(ctx, tableDDLKey(rc))
+	expected, _ := tableDDL(rc)
+	if string(ddl) != expected {
+		t.Errorf("expected DDL to be rewritten as %q, got %q", expected, ddl)
+	}
+}
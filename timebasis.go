@@ -0,0 +1,67 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// The time of an event by which it is archived, which determines its folder's time tokens and
+// the time range in the name of its archive, but not when the batch containing it is due.
+// By default this is the time at which Notehub received the event, but it may instead be the
+// time at which the event was created on the device, so that events buffered on a device are
+// filed by when they happened, or the time at which Notehub routed the event.
+package main
+
+import (
+	"fmt"
+
+	"github.com/blues/note-go/note"
+)
+
+// Times that may be specified in a route's time_basis
+const timeBasisReceived = "received"
+const timeBasisWhen = "when"
+const timeBasisRouted = "routed"
+
+// Policies that may be specified in a route's time_missing, for events lacking the time
+const timeMissingReceived = "received"
+const timeMissingSkip = "skip"
+const timeMissingDeadLetter = "deadletter"
+
+// Validate a time basis
+func validTimeBasis(timeBasis string) (err error) {
+	switch timeBasis {
+	case timeBasisReceived, timeBasisWhen, timeBasisRouted:
+		return nil
+	}
+	return fmt.Errorf("time_basis must be received, when, or routed")
+}
+
+// Validate a missing time policy
+func validTimeMissing(timeMissing string) (err error) {
+	switch timeMissing {
+	case timeMissingReceived, timeMissingSkip, timeMissingDeadLetter:
+		return nil
+	}
+	return fmt.Errorf("time_missing must be received, skip, or deadletter")
+}
+
+// Time of an event in microseconds according to the route's time_basis, returning false if
+// the event lacks that time, in which case its received time is returned.  A time later than
+// the received time, such as from a device whose clock is wrong, is taken to be the received
+// time, so that the event isn't filed in the future.
+func eventTimeUs(rc RouteConfig, event note.Event) (timeUs int64, present bool) {
+	receivedUs := receivedAsInt64(event.Received)
+	switch rc.TimeBasis {
+	case timeBasisWhen:
+		timeUs = event.When * 1000000
+	case timeBasisRouted:
+		timeUs = event.Routed * 1000000
+	default:
+		return receivedUs, true
+	}
+	if timeUs <= 0 {
+		return receivedUs, false
+	}
+	if receivedUs > 0 && timeUs > receivedUs {
+		return receivedUs, true
+	}
+	return timeUs, true
+}
@@ -0,0 +1,41 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/blues/note-go/note"
+)
+
+func TestEventTimeUs(t *testing.T) {
+	event := note.Event{Received: 1656000100.5, When: 1656000000, Routed: 1656000200}
+	tests := []struct {
+		name      string
+		timeBasis string
+		event     note.Event
+		timeUs    int64
+		present   bool
+	}{
+		{"received", timeBasisReceived, event, 1656000100500000, true},
+		{"default", "", event, 1656000100500000, true},
+		{"when", timeBasisWhen, event, 1656000000000000, true},
+		{"missing when", timeBasisWhen, note.Event{Received: 1656000100.5}, 1656000100500000, false},
+		{"routed", timeBasisRouted, note.Event{Received: 1656000100.5, Routed: 1656000050}, 1656000050000000, true},
+		{"missing routed", timeBasisRouted, note.Event{Received: 1656000100.5, When: 1656000000}, 1656000100500000, false},
+
+		// Times later than the event was received are taken to be when it was received,
+		// unless it has no received time to compare them with
+		{"future when", timeBasisWhen, note.Event{Received: 1656000100.5, When: 1956000000}, 1656000100500000, true},
+		{"future routed", timeBasisRouted, event, 1656000100500000, true},
+		{"unreceived when", timeBasisWhen, note.Event{When: 1956000000}, 1956000000000000, true},
+	}
+	for _, test := range tests {
+		timeUs, present := eventTimeUs(RouteConfig{TimeBasis: test.timeBasis}, test.event)
+		if timeUs != test.timeUs || present != test.present {
+			t.Errorf("%s: expected %d %v, got %d %v", test.name, test.timeUs, test.present, timeUs, present)
+		}
+	}
+}